@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	auditCreated  = "created"
+	auditUpdated  = "updated"
+	auditDeleted  = "deleted"
+	auditRestored = "restored"
+	auditPurged   = "purged"
+)
+
+// AuditEntry is one change to a todo, as GET /todos/{id}/history lists it.
+// Entries outlive the todo, so a purged todo's history can still be read.
+type AuditEntry struct {
+	ID int `json:"id"`
+	// TodoID is left out under the idUUID and idULID strategies.
+	TodoID int    `json:"todo_id,omitempty"`
+	Action string `json:"action"`
+	// Actor is the user who made the change; it is null without
+	// authentication and for background jobs.
+	Actor     *string                `json:"actor"`
+	Timestamp time.Time              `json:"timestamp"`
+	Diff      map[string]fieldChange `json:"diff"`
+}
+
+// fieldChange is a field's value before and after a change, null on the
+// side where the todo didn't exist.
+type fieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// auditSkipFields are left out of diffs: they change on every write, or
+// aren't stored with the todo at all.
+var auditSkipFields = []string{"id", "version", "updated_at", "updated_by", "tags", "children"}
+
+// todoDiff returns the fields that differ between before and after, either
+// of which may be nil, in their JSON form.
+func todoDiff(before, after *Todo) map[string]fieldChange {
+	from, to := todoJSONFields(before), todoJSONFields(after)
+	diff := make(map[string]fieldChange)
+	for name := range todoFields {
+		if contains(auditSkipFields, name) {
+			continue
+		}
+		if !reflect.DeepEqual(from[name], to[name]) {
+			diff[name] = fieldChange{From: from[name], To: to[name]}
+		}
+	}
+	return diff
+}
+
+func todoJSONFields(todo *Todo) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if todo == nil {
+		return fields
+	}
+	// A Todo always marshals; the round trip gives values in the same form
+	// the API returns them.
+	data, _ := json.Marshal(todo)
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// recordAudit appends an entry for todo id to the audit log. It must run in
+// the transaction making the change, so the entry is only kept if the change
+// is. owner is who the todo belongs to, which scopes History.
+func (store *TodoSQLStore) recordAudit(ctx context.Context, id int, owner *string, action string, diff map[string]fieldChange) error {
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+	_, err = store.conn().ExecContext(ctx, "INSERT INTO audit_log (todo_id, user_id, actor, action, diff) VALUES (?, ?, ?, ?, ?)", id, owner, actorID(ctx), action, string(data))
+	return err
+}
+
+// getAny reads todo id whether or not it is soft-deleted, or returns nil if
+// there is no such todo.
+func (store *TodoSQLStore) getAny(ctx context.Context, id int) (*Todo, error) {
+	match, args := todoMatch(ctx, id)
+	todo, err := scanTodo(store.conn().QueryRowContext(ctx, "SELECT "+todoColumns+" FROM todos WHERE "+match, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return todo, err
+}
+
+// audited runs change on todo id in a transaction and records it with the
+// difference between the todo before and after. change reports a missing
+// todo itself, and nothing is recorded if it fails.
+func (store *TodoSQLStore) audited(ctx context.Context, id int, action string, change func(tx *TodoSQLStore) error) error {
+	return store.retryTx(ctx, func(tx *TodoSQLStore) error {
+		before, err := tx.getAny(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := change(tx); err != nil {
+			return err
+		}
+		after, err := tx.getAny(ctx, id)
+		if err != nil {
+			return err
+		}
+		return tx.recordAudit(ctx, id, actorID(ctx), action, todoDiff(before, after))
+	})
+}
+
+// queryIDs runs query, an UPDATE ... RETURNING id, and returns the IDs of
+// the rows it changed.
+func (store *TodoSQLStore) queryIDs(ctx context.Context, query string, args ...interface{}) ([]int, error) {
+	rows, err := store.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// History returns todo id's audit log, oldest first. It returns
+// ErrTodoNotFound if the todo has no entries and doesn't exist either.
+func (store *TodoSQLStore) History(ctx context.Context, id int) ([]*AuditEntry, error) {
+	query := "SELECT id, todo_id, actor, action, diff, created_at FROM audit_log WHERE todo_id = ?"
+	args := []interface{}{id}
+	if userID, ok := UserIDFromContext(ctx); ok {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	rows, err := store.conn().QueryContext(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var diff string
+		if err := rows.Scan(&entry.ID, &entry.TodoID, &entry.Actor, &entry.Action, &diff, &entry.Timestamp); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(diff), &entry.Diff); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		todo, err := store.getAny(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if todo == nil {
+			return nil, ErrTodoNotFound
+		}
+	}
+	return entries, nil
+}
+
+// todoHistory serves GET /todos/{id}/history.
+func todoHistory(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		entries, err := store.History(r.Context(), id)
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
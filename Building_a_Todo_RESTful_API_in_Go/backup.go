@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// errBackupUnsupported is returned by Backup for databases it can't copy.
+var errBackupUnsupported = errors.New("backups are only supported for SQLite; use pg_dump for Postgres")
+
+// Backup writes a consistent copy of the database to path, which must not
+// exist yet. It uses VACUUM INTO, which reads from a single transaction, so
+// it is safe while the server keeps serving; writes wait until it is done.
+func (db *DB) Backup(ctx context.Context, path string) error {
+	if db.Driver != driverSQLite {
+		return errBackupUnsupported
+	}
+	_, err := db.ExecContext(ctx, "VACUUM INTO ?", path)
+	return err
+}
+
+// downloadBackup serves GET /admin/backup: a snapshot of the database,
+// streamed as a file download.
+func downloadBackup(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dir, err := os.MkdirTemp("", "todos-backup-")
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "backup.db")
+		err = db.Backup(r.Context(), path)
+		if errors.Is(err, errBackupUnsupported) {
+			writeJSONError(w, http.StatusNotImplemented, "not_implemented", err.Error())
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		name := fmt.Sprintf("todos-%s.db", time.Now().UTC().Format("20060102T150405Z"))
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := io.Copy(w, f); err != nil {
+			// The status is already sent; all that's left is to log it.
+			recordError(w, err)
+		}
+	}
+}
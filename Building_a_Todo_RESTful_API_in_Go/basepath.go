@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const basePathKey contextKey = "base_path"
+
+// BasePathFromContext returns the prefix mountAt stripped from the request's
+// path, or "" when the API is served at the root. Handlers put it in front
+// of any path they send back to the client.
+func BasePathFromContext(ctx context.Context) string {
+	prefix, _ := ctx.Value(basePathKey).(string)
+	return prefix
+}
+
+// mountAt serves next under prefix, which has no trailing slash. The prefix
+// is stripped before next sees the request, so routes and the path checks in
+// the other middleware are written as if the API were at the root; requests
+// outside it get a 404. An empty prefix leaves next as it is.
+func mountAt(prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if prefix == "" {
+			return next
+		}
+		strip := http.StripPrefix(prefix, next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rest, ok := strings.CutPrefix(r.URL.Path, prefix)
+			if !ok || !strings.HasPrefix(rest, "/") {
+				writeJSONError(w, http.StatusNotFound, "not_found", "no such endpoint; the API is served under "+prefix)
+				return
+			}
+			ctx := context.WithValue(r.Context(), basePathKey, prefix)
+			strip.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
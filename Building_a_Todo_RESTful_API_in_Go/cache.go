@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// cacheKey is a todo as seen by one user. Whether JWT auth is on is decided
+// for the whole process, so a todo is only ever fetched and changed under
+// one key and invalidating that key is enough.
+type cacheKey struct {
+	userID string
+	id     int
+}
+
+// cachingStore wraps a TodoStore with an LRU cache in front of GetByID.
+// Every mutation that can change what GetByID returns invalidates the todos
+// it touched, or the whole cache when it touched many. The cache lives in
+// this process only, so it must not be used with several servers sharing
+// one database.
+type cachingStore struct {
+	TodoStore
+	cache *lru.Cache[cacheKey, *Todo]
+
+	// mu orders fills against invalidations: a GetByID that started before
+	// an invalidation must not put what it read back in afterwards. gen is
+	// bumped on every invalidation, and a fill is dropped if it moved.
+	mu  sync.Mutex
+	gen uint64
+}
+
+// newCachingStore caches up to size todos from store. size must be
+// positive.
+func newCachingStore(store TodoStore, size int) *cachingStore {
+	cache, err := lru.New[cacheKey, *Todo](size)
+	if err != nil {
+		// lru.New only fails for a size LoadConfig has already refused.
+		panic(err)
+	}
+	return &cachingStore{TodoStore: store, cache: cache}
+}
+
+func todoCacheKey(ctx context.Context, id int) cacheKey {
+	userID, _ := UserIDFromContext(ctx)
+	return cacheKey{userID: userID, id: id}
+}
+
+// GetByID returns a copy of the cached todo, so callers filling in Tags or
+// Children don't change the cache, or loads it from the store.
+func (s *cachingStore) GetByID(ctx context.Context, id int) (*Todo, error) {
+	key := todoCacheKey(ctx, id)
+	if todo, ok := s.cache.Get(key); ok {
+		copied := *todo
+		return &copied, nil
+	}
+	s.mu.Lock()
+	gen := s.gen
+	s.mu.Unlock()
+
+	todo, err := s.TodoStore.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	cached := *todo
+	s.mu.Lock()
+	if s.gen == gen {
+		s.cache.Add(key, &cached)
+	}
+	s.mu.Unlock()
+	return todo, nil
+}
+
+// invalidate drops todo id from the cache. It runs after the mutation,
+// whether or not it succeeded.
+func (s *cachingStore) invalidate(ctx context.Context, id int) {
+	s.mu.Lock()
+	s.gen++
+	s.cache.Remove(todoCacheKey(ctx, id))
+	s.mu.Unlock()
+}
+
+// purge empties the cache after a mutation that may have touched any todo.
+func (s *cachingStore) purge() {
+	s.mu.Lock()
+	s.gen++
+	s.cache.Purge()
+	s.mu.Unlock()
+}
+
+func (s *cachingStore) Update(ctx context.Context, todo *Todo) error {
+	defer s.invalidate(ctx, todo.ID)
+	return s.TodoStore.Update(ctx, todo)
+}
+
+func (s *cachingStore) UpdateFields(ctx context.Context, id int, fields map[string]interface{}) error {
+	defer s.invalidate(ctx, id)
+	return s.TodoStore.UpdateFields(ctx, id, fields)
+}
+
+func (s *cachingStore) ToggleCompleted(ctx context.Context, id int) (*Todo, error) {
+	defer s.invalidate(ctx, id)
+	return s.TodoStore.ToggleCompleted(ctx, id)
+}
+
+func (s *cachingStore) Delete(ctx context.Context, id int) error {
+	defer s.invalidate(ctx, id)
+	return s.TodoStore.Delete(ctx, id)
+}
+
+func (s *cachingStore) HardDelete(ctx context.Context, id int) error {
+	defer s.invalidate(ctx, id)
+	return s.TodoStore.HardDelete(ctx, id)
+}
+
+func (s *cachingStore) Archive(ctx context.Context, id int) error {
+	defer s.invalidate(ctx, id)
+	return s.TodoStore.Archive(ctx, id)
+}
+
+func (s *cachingStore) Unarchive(ctx context.Context, id int) error {
+	defer s.invalidate(ctx, id)
+	return s.TodoStore.Unarchive(ctx, id)
+}
+
+// Reorder renumbers every todo of the owner, so anything cached may be off.
+func (s *cachingStore) Reorder(ctx context.Context, id, position int) error {
+	defer s.purge()
+	return s.TodoStore.Reorder(ctx, id, position)
+}
+
+func (s *cachingStore) DeleteCompleted(ctx context.Context) (int, error) {
+	defer s.purge()
+	return s.TodoStore.DeleteCompleted(ctx)
+}
+
+func (s *cachingStore) DeleteMany(ctx context.Context, ids []int) (int, error) {
+	defer func() {
+		for _, id := range ids {
+			s.invalidate(ctx, id)
+		}
+	}()
+	return s.TodoStore.DeleteMany(ctx, ids)
+}
+
+func (s *cachingStore) CompleteAll(ctx context.Context) (int, error) {
+	defer s.purge()
+	return s.TodoStore.CompleteAll(ctx)
+}
+
+// AddTag and RemoveTag bump the todo's version.
+func (s *cachingStore) AddTag(ctx context.Context, id int, tag string) error {
+	defer s.invalidate(ctx, id)
+	return s.TodoStore.AddTag(ctx, id, tag)
+}
+
+func (s *cachingStore) RemoveTag(ctx context.Context, id int, tag string) error {
+	defer s.invalidate(ctx, id)
+	return s.TodoStore.RemoveTag(ctx, id, tag)
+}
+
+// purgingSpawner empties the cache after each recurrence run that spawned
+// anything, since SpawnRecurring changes todos behind cachingStore's back.
+type purgingSpawner struct {
+	recurrenceSpawner
+	cache *cachingStore
+}
+
+func (s purgingSpawner) SpawnRecurring(ctx context.Context) (int, error) {
+	n, err := s.recurrenceSpawner.SpawnRecurring(ctx)
+	if n > 0 || err != nil {
+		s.cache.purge()
+	}
+	return n, err
+}
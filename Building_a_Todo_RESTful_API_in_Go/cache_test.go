@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// mustGet fetches todo id from store and checks that it was cached.
+func mustGet(t *testing.T, ctx context.Context, store *cachingStore, id int) *Todo {
+	t.Helper()
+	todo, err := store.GetByID(ctx, id)
+	if err != nil {
+		t.Fatalf("GetByID(%d): %v", id, err)
+	}
+	if !store.cache.Contains(todoCacheKey(ctx, id)) {
+		t.Fatalf("GetByID(%d) didn't fill the cache", id)
+	}
+	return todo
+}
+
+func TestCachingStoreInvalidatesOnMutation(t *testing.T) {
+	eachStore(t, func(t *testing.T, backing TodoStore) {
+		ctx := context.Background()
+		store := newCachingStore(backing, 16)
+		created := mustCreate(t, ctx, store, "before", nil)
+
+		todo := mustGet(t, ctx, store, created.ID)
+		todo.Title = "after update"
+		if err := store.Update(ctx, todo); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if got := mustGet(t, ctx, store, created.ID); got.Title != "after update" {
+			t.Errorf("title after Update = %q, want %q", got.Title, "after update")
+		}
+
+		if err := store.UpdateFields(ctx, created.ID, map[string]interface{}{"title": "after patch"}); err != nil {
+			t.Fatalf("UpdateFields: %v", err)
+		}
+		if got := mustGet(t, ctx, store, created.ID); got.Title != "after patch" {
+			t.Errorf("title after UpdateFields = %q, want %q", got.Title, "after patch")
+		}
+
+		if _, err := store.ToggleCompleted(ctx, created.ID); err != nil {
+			t.Fatalf("ToggleCompleted: %v", err)
+		}
+		if got := mustGet(t, ctx, store, created.ID); !got.Completed {
+			t.Error("completed after ToggleCompleted = false, want true")
+		}
+
+		if err := store.Delete(ctx, created.ID); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := store.GetByID(ctx, created.ID); !errors.Is(err, ErrTodoNotFound) {
+			t.Errorf("GetByID after Delete = %v, want ErrTodoNotFound", err)
+		}
+	})
+}
+
+func BenchmarkGetByID(b *testing.B) {
+	bench := func(b *testing.B, store TodoStore) {
+		ctx := context.Background()
+		todo, err := store.Create(ctx, &Todo{Title: "bench"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for b.Loop() {
+			if _, err := store.GetByID(ctx, todo.ID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("uncached", func(b *testing.B) { bench(b, newTestSQLStore(b)) })
+	b.Run("cached", func(b *testing.B) { bench(b, newCachingStore(newTestSQLStore(b), 16)) })
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinSize is the smallest response worth compressing; below it the gzip
+// header and trailer eat most of the saving.
+const gzipMinSize = 1024
+
+// compress gzips responses for clients that accept it, at the given
+// compress/gzip level. Responses are held back until gzipMinSize bytes have
+// been written, so small ones go out as they are. Streaming paths are left
+// alone: SSE must reach the client event by event and WebSocket upgrades
+// need the raw connection.
+func compress(level int) func(http.Handler) http.Handler {
+	pool := sync.Pool{New: func() interface{} {
+		// The level was checked by LoadConfig.
+		gz, _ := gzip.NewWriterLevel(io.Discard, level)
+		return gz
+	}}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if contains(streamingPaths, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+			if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipResponseWriter{ResponseWriter: w, pool: &pool}
+			defer gw.close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, either
+// by name or through "*", with a non-zero q.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, err := mime.ParseMediaType(part)
+		if err != nil || (coding != "gzip" && coding != "*") {
+			continue
+		}
+		if v, ok := params["q"]; ok {
+			if q, err := strconv.ParseFloat(v, 64); err != nil || q == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of a response to decide whether to
+// compress it, then either gzips everything or passes it through.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	pool *sync.Pool
+	// status is held back along with the body until the decision is made.
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if gw.status == 0 {
+		gw.status = status
+	}
+}
+
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	if !gw.decided {
+		gw.buf.Write(p)
+		if gw.buf.Len() < gzipMinSize {
+			return len(p), nil
+		}
+		if err := gw.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(p)
+	}
+	return gw.ResponseWriter.Write(p)
+}
+
+// decide writes the held-back header, compressing if enough has been
+// buffered and the handler hasn't encoded the body itself, and then flushes
+// the buffer through.
+func (gw *gzipResponseWriter) decide() error {
+	gw.decided = true
+	h := gw.Header()
+	if gw.buf.Len() >= gzipMinSize && h.Get("Content-Encoding") == "" && bodyAllowed(gw.status) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		gw.gz = gw.pool.Get().(*gzip.Writer)
+		gw.gz.Reset(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(gw.buf.Bytes())
+	} else {
+		_, err = gw.ResponseWriter.Write(gw.buf.Bytes())
+	}
+	gw.buf.Reset()
+	return err
+}
+
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// Flush sends what has been written so far. A response flushed before it
+// reached gzipMinSize goes out uncompressed.
+func (gw *gzipResponseWriter) Flush() {
+	if gw.status == 0 {
+		return
+	}
+	if !gw.decided {
+		gw.decide()
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// close finishes the response once the handler returns: a short body is
+// sent as it is and a gzip stream gets its trailer.
+func (gw *gzipResponseWriter) close() {
+	if gw.status == 0 {
+		// Nothing was written; let net/http send its default 200.
+		return
+	}
+	if !gw.decided {
+		gw.decide()
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+		gw.gz.Reset(io.Discard)
+		gw.pool.Put(gw.gz)
+	}
+}
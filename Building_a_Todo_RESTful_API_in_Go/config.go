@@ -0,0 +1,362 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds everything main needs to start the server. Each setting has a
+// default, can be overridden by an environment variable, and that in turn by
+// a command-line flag.
+type Config struct {
+	// Addr is the address the HTTP server listens on (ADDR, -addr).
+	Addr string
+	// BasePath is a path prefix, such as /api/v1, that every route is served
+	// under, for running behind a gateway that doesn't rewrite paths; empty
+	// serves them at the root (BASE_PATH, -base-path).
+	BasePath string
+	// GRPCAddr is the address the gRPC TodoService listens on; empty turns
+	// it off (GRPC_ADDR, -grpc-addr).
+	GRPCAddr string
+	// Store is the storage backend: sqlite, postgres or memory. Left empty
+	// it is sqlite or postgres depending on DBPath (STORE, -store).
+	Store string
+	// DBPath is a SQLite file path or a postgres:// URL for the SQL
+	// backends (DB_PATH, -db).
+	DBPath string
+	// DB tunes the database connection pool (DB_MAX_OPEN_CONNS,
+	// -db-max-open-conns; DB_MAX_IDLE_CONNS, -db-max-idle-conns;
+	// DB_CONN_MAX_LIFETIME, -db-conn-max-lifetime) and SQLite's busy
+	// timeout (SQLITE_BUSY_TIMEOUT, -sqlite-busy-timeout).
+	DB DBOptions
+	// AllowedOrigins are the CORS origins allowed to call the API; "*"
+	// allows any (CORS_ALLOWED_ORIGINS, -cors-origins).
+	AllowedOrigins []string
+	// RequestTimeout caps how long a request's store queries may run
+	// (REQUEST_TIMEOUT, -request-timeout).
+	RequestTimeout time.Duration
+	// APIKeys are the keys accepted in the X-API-Key header. Listing more
+	// than one allows rotating keys; an empty list disables the check
+	// (API_KEYS, -api-keys).
+	APIKeys []string
+	// JWTSecret is the shared secret bearer tokens are signed with. Setting
+	// it turns on per-user todos. It is only read from the environment so
+	// it doesn't show up in process listings (JWT_SECRET).
+	JWTSecret string
+	// AdminAPIKeys are the keys accepted in the X-Admin-Key header for the
+	// endpoints under /admin/; an empty list turns them off. Like JWTSecret
+	// they are only read from the environment (ADMIN_API_KEYS).
+	AdminAPIKeys []string
+	// RateLimit is the number of requests per second each client IP may
+	// make; zero turns rate limiting off (RATE_LIMIT, -rate-limit).
+	RateLimit float64
+	// RateBurst is how many requests a client may make at once before the
+	// rate limit kicks in (RATE_BURST, -rate-burst).
+	RateBurst int
+	// DefaultPageSize is how many todos a list or search returns when the
+	// request doesn't say (DEFAULT_PAGE_SIZE, -default-page-size).
+	DefaultPageSize int
+	// MaxPageSize is the most todos one list or search returns; larger
+	// limits are capped to it (MAX_PAGE_SIZE, -max-page-size).
+	MaxPageSize int
+	// MaxBodyBytes is the largest request body accepted; larger ones get
+	// 413 (MAX_BODY_BYTES, -max-body-bytes).
+	MaxBodyBytes int64
+	// CompressionLevel is the gzip level responses are compressed with, from
+	// 1 (fastest) to 9 (smallest), -1 for the default or -2 for Huffman
+	// only; zero turns compression off (COMPRESSION_LEVEL,
+	// -compression-level).
+	CompressionLevel int
+	// LogLevel is the minimum level logged: debug, info, warn or error
+	// (LOG_LEVEL, -log-level).
+	LogLevel string
+	// LogFormat is text for key=value lines or json for one JSON object per
+	// line (LOG_FORMAT, -log-format).
+	LogFormat string
+	// IdempotencyTTL is how long an Idempotency-Key sent with POST /todos
+	// is remembered (IDEMPOTENCY_TTL, -idempotency-ttl).
+	IdempotencyTTL time.Duration
+	// UndoDepth is how many deletes per user POST /todos/undo can take back
+	// (UNDO_DEPTH, -undo-depth).
+	UndoDepth int
+	// CacheSize is how many todos GetByID keeps in an in-process LRU cache;
+	// zero turns the cache off. Only use it with a single server per
+	// database (CACHE_SIZE, -cache-size).
+	CacheSize int
+	// IDStrategy is how todos are addressed: increment by their integer id,
+	// or uuid or ulid by an external ID generated for each new todo, which
+	// isn't guessable and doesn't give away how many todos there are
+	// (ID_STRATEGY, -id-strategy).
+	IDStrategy string
+	// Quota caps how many todos each user may have (TODO_QUOTA,
+	// -todo-quota), counting completed and archived ones too if CountDone
+	// is set (TODO_QUOTA_COUNT_DONE, -todo-quota-count-done).
+	Quota TodoQuota
+	// Timezone is the IANA time zone, such as Europe/Berlin, whose day GET
+	// /todos/today covers when a request doesn't name one (TIMEZONE,
+	// -timezone).
+	Timezone string
+	// ReadOnly serves reads but refuses every write, over HTTP with 503,
+	// and pauses the recurrence and reminder jobs, for maintenance
+	// (READ_ONLY, -read-only).
+	ReadOnly bool
+	// ReminderInterval is how often overdue todos are looked for; zero turns
+	// reminders off (REMINDER_INTERVAL, -reminder-interval).
+	ReminderInterval time.Duration
+	// ReminderWebhookURL, if set, receives each reminder as a JSON POST;
+	// otherwise reminders are only logged (REMINDER_WEBHOOK_URL,
+	// -reminder-webhook-url).
+	ReminderWebhookURL string
+	// WebhookURLs each receive a JSON POST for every todo created, updated
+	// or deleted (WEBHOOK_URLS, -webhook-urls).
+	WebhookURLs []string
+	// ShutdownTimeout bounds how long in-flight requests get to finish once
+	// a shutdown signal arrives (SHUTDOWN_TIMEOUT, -shutdown-timeout).
+	ShutdownTimeout time.Duration
+	// ReadHeaderTimeout is how long a client has to send a request's
+	// headers (READ_HEADER_TIMEOUT, -read-header-timeout).
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is how long a client has to send a whole request, body
+	// included (READ_TIMEOUT, -read-timeout).
+	ReadTimeout time.Duration
+	// WriteTimeout is how long a response may take from the end of the
+	// request headers. It should be longer than RequestTimeout. The event
+	// stream lifts it for its own connection (WRITE_TIMEOUT,
+	// -write-timeout).
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a keep-alive connection may sit between
+	// requests (IDLE_TIMEOUT, -idle-timeout).
+	IdleTimeout time.Duration
+}
+
+// LoadConfig builds a Config from the defaults, the environment and args,
+// which should not include the program name.
+func LoadConfig(args []string) (*Config, error) {
+	env := &envLoader{}
+	cfg := &Config{
+		Addr:     env.string("ADDR", ":8080"),
+		BasePath: env.string("BASE_PATH", ""),
+		GRPCAddr: env.string("GRPC_ADDR", ""),
+		Store:    env.string("STORE", ""),
+		DBPath:   env.string("DB_PATH", "todos.db"),
+		DB: DBOptions{
+			MaxOpenConns:    env.int("DB_MAX_OPEN_CONNS", 0),
+			MaxIdleConns:    env.int("DB_MAX_IDLE_CONNS", 0),
+			ConnMaxLifetime: env.duration("DB_CONN_MAX_LIFETIME", 0),
+			BusyTimeout:     env.duration("SQLITE_BUSY_TIMEOUT", defaultBusyTimeout),
+		},
+		AllowedOrigins:     env.list("CORS_ALLOWED_ORIGINS", []string{"*"}),
+		RequestTimeout:     env.duration("REQUEST_TIMEOUT", 30*time.Second),
+		ShutdownTimeout:    env.duration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		ReadHeaderTimeout:  env.duration("READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:        env.duration("READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:       env.duration("WRITE_TIMEOUT", time.Minute),
+		IdleTimeout:        env.duration("IDLE_TIMEOUT", 2*time.Minute),
+		APIKeys:            env.list("API_KEYS", nil),
+		JWTSecret:          env.string("JWT_SECRET", ""),
+		AdminAPIKeys:       env.list("ADMIN_API_KEYS", nil),
+		RateLimit:          env.float("RATE_LIMIT", 0),
+		RateBurst:          env.int("RATE_BURST", 20),
+		DefaultPageSize:    env.int("DEFAULT_PAGE_SIZE", defaultPageSize),
+		MaxPageSize:        env.int("MAX_PAGE_SIZE", maxPageSize),
+		MaxBodyBytes:       int64(env.int("MAX_BODY_BYTES", 1<<20)),
+		CompressionLevel:   env.int("COMPRESSION_LEVEL", gzip.DefaultCompression),
+		LogLevel:           env.string("LOG_LEVEL", "info"),
+		LogFormat:          env.string("LOG_FORMAT", "text"),
+		IdempotencyTTL:     env.duration("IDEMPOTENCY_TTL", defaultIdempotencyTTL),
+		UndoDepth:          env.int("UNDO_DEPTH", defaultUndoDepth),
+		CacheSize:          env.int("CACHE_SIZE", 0),
+		IDStrategy:         env.string("ID_STRATEGY", idIncrement),
+		ReminderInterval:   env.duration("REMINDER_INTERVAL", time.Minute),
+		ReminderWebhookURL: env.string("REMINDER_WEBHOOK_URL", ""),
+		WebhookURLs:        env.list("WEBHOOK_URLS", nil),
+		Timezone:           env.string("TIMEZONE", "UTC"),
+		ReadOnly:           env.bool("READ_ONLY", false),
+		Quota: TodoQuota{
+			Max:       env.int("TODO_QUOTA", 0),
+			CountDone: env.bool("TODO_QUOTA_COUNT_DONE", false),
+		},
+	}
+	if env.err != nil {
+		return nil, env.err
+	}
+
+	fs := flag.NewFlagSet("todos", flag.ContinueOnError)
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "address to listen on")
+	fs.StringVar(&cfg.BasePath, "base-path", cfg.BasePath, "path prefix to serve every route under, e.g. /api/v1")
+	fs.StringVar(&cfg.GRPCAddr, "grpc-addr", cfg.GRPCAddr, "address for the gRPC service to listen on, empty to turn it off")
+	fs.StringVar(&cfg.Store, "store", cfg.Store, "storage backend: sqlite, postgres or memory; picked from -db if empty")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "SQLite file path or postgres:// URL")
+	fs.IntVar(&cfg.DB.MaxOpenConns, "db-max-open-conns", cfg.DB.MaxOpenConns, "maximum open database connections, 0 for the driver default (1 for SQLite)")
+	fs.IntVar(&cfg.DB.MaxIdleConns, "db-max-idle-conns", cfg.DB.MaxIdleConns, "maximum idle database connections, 0 for the default")
+	fs.DurationVar(&cfg.DB.ConnMaxLifetime, "db-conn-max-lifetime", cfg.DB.ConnMaxLifetime, "maximum age of a database connection, 0 for no limit")
+	fs.DurationVar(&cfg.DB.BusyTimeout, "sqlite-busy-timeout", cfg.DB.BusyTimeout, "how long SQLite waits for a locked database")
+	origins := fs.String("cors-origins", strings.Join(cfg.AllowedOrigins, ","), "comma-separated CORS origins, * for any")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", cfg.RequestTimeout, "maximum time spent serving one request")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "time allowed for in-flight requests on shutdown")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", cfg.ReadHeaderTimeout, "time allowed for reading request headers, 0 to use the read timeout")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "time allowed for reading a whole request, 0 for no limit")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "time allowed for writing a response, 0 for no limit")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "how long idle keep-alive connections are kept, 0 to use the read timeout")
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", cfg.RateLimit, "requests per second allowed per client IP, 0 for no limit")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", cfg.RateBurst, "requests a client may burst above the rate limit")
+	fs.IntVar(&cfg.DefaultPageSize, "default-page-size", cfg.DefaultPageSize, "todos returned per page when the request doesn't say")
+	fs.IntVar(&cfg.MaxPageSize, "max-page-size", cfg.MaxPageSize, "most todos returned per page")
+	fs.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", cfg.MaxBodyBytes, "largest request body accepted, in bytes")
+	fs.IntVar(&cfg.CompressionLevel, "compression-level", cfg.CompressionLevel, "gzip level for responses, 1-9, -1 for the default, 0 to turn compression off")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "minimum log level: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "log format: text or json")
+	fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", cfg.IdempotencyTTL, "how long Idempotency-Key values are remembered")
+	fs.IntVar(&cfg.UndoDepth, "undo-depth", cfg.UndoDepth, "how many deletes per user POST /todos/undo can take back")
+	fs.IntVar(&cfg.CacheSize, "cache-size", cfg.CacheSize, "how many todos to cache in memory for lookups by ID, 0 to turn the cache off")
+	fs.StringVar(&cfg.IDStrategy, "id-strategy", cfg.IDStrategy, "how todos are addressed: "+strings.Join(idStrategies, ", "))
+	fs.IntVar(&cfg.Quota.Max, "todo-quota", cfg.Quota.Max, "most todos each user may have, 0 for no limit")
+	fs.BoolVar(&cfg.Quota.CountDone, "todo-quota-count-done", cfg.Quota.CountDone, "count completed and archived todos against the quota too")
+	fs.StringVar(&cfg.Timezone, "timezone", cfg.Timezone, "IANA time zone whose day GET /todos/today covers by default")
+	fs.BoolVar(&cfg.ReadOnly, "read-only", cfg.ReadOnly, "serve reads only, answering writes with 503")
+	fs.DurationVar(&cfg.ReminderInterval, "reminder-interval", cfg.ReminderInterval, "how often to look for overdue todos, 0 to turn reminders off")
+	fs.StringVar(&cfg.ReminderWebhookURL, "reminder-webhook-url", cfg.ReminderWebhookURL, "URL to POST overdue reminders to; they are logged if unset")
+	webhookURLs := fs.String("webhook-urls", strings.Join(cfg.WebhookURLs, ","), "comma-separated URLs to POST todo changes to")
+	apiKeys := fs.String("api-keys", strings.Join(cfg.APIKeys, ","), "comma-separated API keys accepted in X-API-Key")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg.AllowedOrigins = splitList(*origins)
+	cfg.APIKeys = splitList(*apiKeys)
+	cfg.WebhookURLs = splitList(*webhookURLs)
+	if cfg.Store == "" {
+		cfg.Store = backendSQLite
+		if isPostgresURL(cfg.DBPath) {
+			cfg.Store = backendPostgres
+		}
+	}
+	if _, ok := storeFactories[cfg.Store]; !ok {
+		return nil, fmt.Errorf("invalid store %q: must be one of %s", cfg.Store, backendNames())
+	}
+	if (cfg.Store == backendPostgres) != isPostgresURL(cfg.DBPath) && cfg.Store != backendMemory {
+		return nil, fmt.Errorf("store %s doesn't match database %q: postgres needs a postgres:// URL and sqlite a file path", cfg.Store, cfg.DBPath)
+	}
+	cfg.BasePath = strings.TrimRight(cfg.BasePath, "/")
+	if cfg.BasePath != "" && (!strings.HasPrefix(cfg.BasePath, "/") || strings.ContainsAny(cfg.BasePath, "?#{}")) {
+		return nil, fmt.Errorf("invalid base path %q: must start with / and be a plain path", cfg.BasePath)
+	}
+	if cfg.MaxPageSize < 1 || cfg.DefaultPageSize < 1 || cfg.DefaultPageSize > cfg.MaxPageSize {
+		return nil, fmt.Errorf("invalid page sizes: need 1 <= default (%d) <= max (%d)", cfg.DefaultPageSize, cfg.MaxPageSize)
+	}
+	if cfg.CacheSize < 0 {
+		return nil, fmt.Errorf("invalid cache size %d: must be 0 or more", cfg.CacheSize)
+	}
+	if !contains(idStrategies, cfg.IDStrategy) {
+		return nil, fmt.Errorf("invalid id strategy %q: must be one of %s", cfg.IDStrategy, strings.Join(idStrategies, ", "))
+	}
+	if cfg.Quota.Max < 0 {
+		return nil, fmt.Errorf("invalid todo quota %d: must be 0 or more", cfg.Quota.Max)
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: must be an IANA time zone such as Europe/Berlin", cfg.Timezone)
+	}
+	if cfg.CompressionLevel < gzip.HuffmanOnly || cfg.CompressionLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d: must be between %d and %d", cfg.CompressionLevel, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	for _, u := range cfg.WebhookURLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q: must be an absolute http or https URL", u)
+		}
+	}
+	return cfg, nil
+}
+
+// envLoader reads typed settings from the environment, remembering the first
+// value that fails to parse.
+type envLoader struct {
+	err error
+}
+
+func (e *envLoader) string(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+func (e *envLoader) list(key string, def []string) []string {
+	if v, ok := os.LookupEnv(key); ok {
+		return splitList(v)
+	}
+	return def
+}
+
+func (e *envLoader) duration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail(key, v, err)
+		return def
+	}
+	return d
+}
+
+func (e *envLoader) int(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.fail(key, v, err)
+		return def
+	}
+	return n
+}
+
+func (e *envLoader) bool(key string, def bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(key, v, err)
+		return def
+	}
+	return b
+}
+
+func (e *envLoader) float(key string, def float64) float64 {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.fail(key, v, err)
+		return def
+	}
+	return f
+}
+
+func (e *envLoader) fail(key, value string, err error) {
+	if e.err == nil {
+		e.err = fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types sent on GET /todos/events. eventChanged covers operations that
+// touch several todos at once; it carries no todo, and clients should
+// re-fetch whatever they show.
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+	eventChanged = "changed"
+)
+
+const (
+	// subscriberBuffer is how many events a slow stream may fall behind
+	// before further events to it are dropped.
+	subscriberBuffer = 16
+	// heartbeatInterval is how often an idle stream gets a comment line,
+	// so proxies don't close it.
+	heartbeatInterval = 15 * time.Second
+)
+
+// todoEvent is one change published by a store mutation. Deletes carry just
+// the todo's ID, and under the idUUID and idULID strategies just its
+// external ID.
+type todoEvent struct {
+	Type       string `json:"type"`
+	ID         int    `json:"id,omitempty"`
+	ExternalID string `json:"external_id,omitempty"`
+	Todo       *Todo  `json:"todo,omitempty"`
+	// userID owns the todo; only that user's subscribers see the event.
+	userID string
+}
+
+// broker fans events out to subscribers in process.
+type broker struct {
+	mu   sync.Mutex
+	subs map[chan todoEvent]string
+	// done is closed when the server shuts down, ending every stream;
+	// Shutdown doesn't cancel the contexts of requests still running.
+	done         chan struct{}
+	closeOnce    sync.Once
+	registerOnce sync.Once
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[chan todoEvent]string), done: make(chan struct{})}
+}
+
+// closeOnShutdown arranges for the broker to be closed when srv shuts down.
+func (b *broker) closeOnShutdown(srv *http.Server) {
+	b.registerOnce.Do(func() {
+		srv.RegisterOnShutdown(func() {
+			b.closeOnce.Do(func() { close(b.done) })
+		})
+	})
+}
+
+// subscribe registers a subscriber for the events userID may see; an empty
+// userID sees every event. The subscriber may fall up to buffer events
+// behind. Call the returned function to unsubscribe.
+func (b *broker) subscribe(userID string, buffer int) (<-chan todoEvent, func()) {
+	ch := make(chan todoEvent, buffer)
+	b.mu.Lock()
+	b.subs[ch] = userID
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// publish hands ev to every subscriber allowed to see it without blocking;
+// a subscriber whose buffer is full misses the event.
+func (b *broker) publish(ev todoEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, userID := range b.subs {
+		if userID != "" && userID != ev.userID {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// publishingStore wraps a TodoStore and publishes an event to broker after
+// each successful mutation. With keysOnly set, events leave out integer ids.
+type publishingStore struct {
+	TodoStore
+	broker   *broker
+	keysOnly bool
+}
+
+func (s *publishingStore) emit(ctx context.Context, typ string, id int, todo *Todo) {
+	if s.keysOnly {
+		id = 0
+	}
+	userID, _ := UserIDFromContext(ctx)
+	s.broker.publish(todoEvent{Type: typ, ID: id, Todo: todo, userID: userID})
+}
+
+// emitDeleted publishes the delete of id, named by key with keysOnly set.
+func (s *publishingStore) emitDeleted(ctx context.Context, id int, key string) {
+	if s.keysOnly {
+		id = 0
+	}
+	userID, _ := UserIDFromContext(ctx)
+	s.broker.publish(todoEvent{Type: eventDeleted, ID: id, ExternalID: key, userID: userID})
+}
+
+// keyOf returns the external ID of id with keysOnly set, for the event of a
+// delete that is about to happen. A todo it can't read goes unnamed.
+func (s *publishingStore) keyOf(ctx context.Context, id int) string {
+	if !s.keysOnly {
+		return ""
+	}
+	todo, err := s.TodoStore.GetByID(ctx, id)
+	if err != nil || todo.ExternalID == nil {
+		return ""
+	}
+	return *todo.ExternalID
+}
+
+// emitCurrent publishes the todo as it is now, after a mutation that doesn't
+// return it.
+func (s *publishingStore) emitCurrent(ctx context.Context, typ string, id int) {
+	todo, _ := s.TodoStore.GetByID(ctx, id)
+	s.emit(ctx, typ, id, todo)
+}
+
+func (s *publishingStore) Create(ctx context.Context, todo *Todo) (*Todo, error) {
+	created, err := s.TodoStore.Create(ctx, todo)
+	if err == nil {
+		s.emit(ctx, eventCreated, created.ID, created)
+	}
+	return created, err
+}
+
+func (s *publishingStore) CreateIdempotent(ctx context.Context, key string, todo *Todo) (*Todo, bool, error) {
+	created, replayed, err := s.TodoStore.CreateIdempotent(ctx, key, todo)
+	if err == nil && !replayed {
+		s.emit(ctx, eventCreated, created.ID, created)
+	}
+	return created, replayed, err
+}
+
+func (s *publishingStore) CreateBulk(ctx context.Context, todos []*Todo) ([]*Todo, error) {
+	created, err := s.TodoStore.CreateBulk(ctx, todos)
+	if err == nil {
+		for _, todo := range created {
+			s.emit(ctx, eventCreated, todo.ID, todo)
+		}
+	}
+	return created, err
+}
+
+func (s *publishingStore) Import(ctx context.Context, next func() (*Todo, error), opts ImportOptions) (*ImportResult, error) {
+	result, err := s.TodoStore.Import(ctx, next, opts)
+	if err == nil && result.Imported > 0 && !opts.DryRun {
+		s.emit(ctx, eventChanged, 0, nil)
+	}
+	return result, err
+}
+
+func (s *publishingStore) Update(ctx context.Context, todo *Todo) error {
+	err := s.TodoStore.Update(ctx, todo)
+	if err == nil {
+		s.emitCurrent(ctx, eventUpdated, todo.ID)
+	}
+	return err
+}
+
+func (s *publishingStore) UpdateFields(ctx context.Context, id int, fields map[string]interface{}) error {
+	err := s.TodoStore.UpdateFields(ctx, id, fields)
+	if err == nil {
+		s.emitCurrent(ctx, eventUpdated, id)
+	}
+	return err
+}
+
+func (s *publishingStore) ToggleCompleted(ctx context.Context, id int) (*Todo, error) {
+	todo, err := s.TodoStore.ToggleCompleted(ctx, id)
+	if err == nil {
+		s.emit(ctx, eventUpdated, todo.ID, todo)
+	}
+	return todo, err
+}
+
+func (s *publishingStore) Delete(ctx context.Context, id int) error {
+	key := s.keyOf(ctx, id)
+	err := s.TodoStore.Delete(ctx, id)
+	if err == nil {
+		s.emitDeleted(ctx, id, key)
+	}
+	return err
+}
+
+func (s *publishingStore) HardDelete(ctx context.Context, id int) error {
+	key := s.keyOf(ctx, id)
+	err := s.TodoStore.HardDelete(ctx, id)
+	if err == nil {
+		s.emitDeleted(ctx, id, key)
+	}
+	return err
+}
+
+func (s *publishingStore) RestoreDeleted(ctx context.Context, id int) error {
+	err := s.TodoStore.RestoreDeleted(ctx, id)
+	if err == nil {
+		s.emitCurrent(ctx, eventCreated, id)
+	}
+	return err
+}
+
+func (s *publishingStore) Undo(ctx context.Context) (*Todo, error) {
+	todo, err := s.TodoStore.Undo(ctx)
+	if err == nil {
+		s.emit(ctx, eventCreated, todo.ID, todo)
+	}
+	return todo, err
+}
+
+func (s *publishingStore) Archive(ctx context.Context, id int) error {
+	err := s.TodoStore.Archive(ctx, id)
+	if err == nil {
+		s.emitCurrent(ctx, eventUpdated, id)
+	}
+	return err
+}
+
+func (s *publishingStore) Unarchive(ctx context.Context, id int) error {
+	err := s.TodoStore.Unarchive(ctx, id)
+	if err == nil {
+		s.emitCurrent(ctx, eventUpdated, id)
+	}
+	return err
+}
+
+// Reorder shifts the positions of other todos too, so it is reported as a
+// change to the whole list.
+func (s *publishingStore) Reorder(ctx context.Context, id, position int) error {
+	err := s.TodoStore.Reorder(ctx, id, position)
+	if err == nil {
+		s.emit(ctx, eventChanged, 0, nil)
+	}
+	return err
+}
+
+func (s *publishingStore) DeleteCompleted(ctx context.Context) (int, error) {
+	n, err := s.TodoStore.DeleteCompleted(ctx)
+	if err == nil && n > 0 {
+		s.emit(ctx, eventChanged, 0, nil)
+	}
+	return n, err
+}
+
+func (s *publishingStore) DeleteMany(ctx context.Context, ids []int) (int, error) {
+	n, err := s.TodoStore.DeleteMany(ctx, ids)
+	if err == nil && n > 0 {
+		s.emit(ctx, eventChanged, 0, nil)
+	}
+	return n, err
+}
+
+func (s *publishingStore) CompleteAll(ctx context.Context) (int, error) {
+	n, err := s.TodoStore.CompleteAll(ctx)
+	if err == nil && n > 0 {
+		s.emit(ctx, eventChanged, 0, nil)
+	}
+	return n, err
+}
+
+func (s *publishingStore) AddTag(ctx context.Context, id int, tag string) error {
+	err := s.TodoStore.AddTag(ctx, id, tag)
+	if err == nil {
+		s.emitCurrent(ctx, eventUpdated, id)
+	}
+	return err
+}
+
+func (s *publishingStore) RemoveTag(ctx context.Context, id int, tag string) error {
+	err := s.TodoStore.RemoveTag(ctx, id, tag)
+	if err == nil {
+		s.emitCurrent(ctx, eventUpdated, id)
+	}
+	return err
+}
+
+// streamEvents serves GET /todos/events as a Server-Sent Events stream of
+// the changes the caller may see, until the client goes away. The server's
+// WriteTimeout would cut the stream off, so it is lifted for this response.
+func streamEvents(b *broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok {
+			b.closeOnShutdown(srv)
+		}
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			recordError(w, err)
+			return
+		}
+		// A HEAD request gets the stream's headers and no stream, which
+		// would otherwise never end.
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		userID, _ := UserIDFromContext(r.Context())
+		events, unsubscribe := b.subscribe(userID, subscriberBuffer)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			recordError(w, err)
+			return
+		}
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-b.done:
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case ev := <-events:
+				data, err := json.Marshal(ev)
+				if err != nil {
+					recordError(w, err)
+					return
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The ID strategies Config.IDStrategy can name. Todos always have an integer
+// id; under idUUID and idULID every new todo also gets a generated external
+// ID, and the API takes and shows only that, so todos can't be found by
+// counting.
+const (
+	idIncrement = "increment"
+	idUUID      = "uuid"
+	idULID      = "ulid"
+)
+
+var idStrategies = []string{idIncrement, idUUID, idULID}
+
+// isKeysOnly reports whether strategy addresses todos by external ID alone.
+func isKeysOnly(strategy string) bool {
+	return strategy == idUUID || strategy == idULID
+}
+
+// crockford is the base32 alphabet ULIDs are written in.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// errExternalIDTaken is returned by Create for an external_id that belongs
+// to another user's todo, or to a deleted one. Restoring the deleted todo
+// frees it for retries again.
+var errExternalIDTaken = &ValidationError{Field: "external_id", Message: "is already used by another todo"}
+
+// validateExternalID checks that id is a UUID in its usual 8-4-4-4-12 hex
+// form or a ULID, and returns it in canonical case: lower for a UUID and
+// upper for a ULID, so the same ID written either way is one ID.
+func validateExternalID(id string) (string, error) {
+	invalid := &ValidationError{Field: "external_id", Message: "must be a UUID or ULID"}
+	switch len(id) {
+	case 26:
+		id = strings.ToUpper(id)
+		// The first character only carries the top 3 of a ULID's 128 bits.
+		if id[0] > '7' {
+			return "", invalid
+		}
+		for _, c := range id {
+			if !strings.ContainsRune(crockford, c) {
+				return "", invalid
+			}
+		}
+		return id, nil
+	case 36:
+		id = strings.ToLower(id)
+		for i, c := range id {
+			switch i {
+			case 8, 13, 18, 23:
+				if c != '-' {
+					return "", invalid
+				}
+			default:
+				if !strings.ContainsRune("0123456789abcdef", c) {
+					return "", invalid
+				}
+			}
+		}
+		return id, nil
+	}
+	return "", invalid
+}
+
+// newExternalID returns a fresh external ID for strategy: a random version 4
+// UUID, or a ULID, which sorts by creation time. It returns nil for
+// idIncrement.
+func newExternalID(strategy string) *string {
+	var id string
+	switch strategy {
+	case idUUID:
+		id = newUUID()
+	case idULID:
+		id = newULID()
+	default:
+		return nil
+	}
+	return &id
+}
+
+// newULID returns a ULID for the current time: 48 bits of Unix milliseconds
+// followed by 80 random bits, written 5 bits at a time from the end.
+func newULID() string {
+	var b [10]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	hi := uint64(time.Now().UnixMilli())<<16 | uint64(binary.BigEndian.Uint16(b[:2]))
+	lo := binary.BigEndian.Uint64(b[2:])
+	out := make([]byte, 26)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// byExternalID returns the user's live todo with external ID id, or nil if
+// id is nil or no todo has it yet.
+func (store *TodoSQLStore) byExternalID(ctx context.Context, id *string) (*Todo, error) {
+	if id == nil {
+		return nil, nil
+	}
+	var todoID int
+	err := store.conn().QueryRowContext(ctx, "SELECT id FROM todos WHERE external_id = ?", *id).Scan(&todoID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	todo, err := store.getAny(ctx, todoID)
+	if err != nil {
+		return nil, err
+	}
+	if todo == nil || todo.DeletedAt != nil {
+		return nil, errExternalIDTaken
+	}
+	return todo, nil
+}
+
+// byExternalID is the InMemoryTodoStore version. The caller holds mu.
+func (s *InMemoryTodoStore) byExternalID(ctx context.Context, id *string) (*memTodo, error) {
+	if id == nil {
+		return nil, nil
+	}
+	for _, t := range s.todos {
+		if t.ExternalID == nil || *t.ExternalID != *id {
+			continue
+		}
+		if !visible(ctx, t) || t.DeletedAt != nil {
+			return nil, errExternalIDTaken
+		}
+		return t, nil
+	}
+	return nil, nil
+}
+
+// ResolveKey returns the id of the user's todo with external ID key, deleted
+// or not, or ErrTodoNotFound.
+func (store *TodoSQLStore) ResolveKey(ctx context.Context, key string) (int, error) {
+	query, args := "SELECT id FROM todos WHERE external_id = ?", []interface{}{key}
+	if userID, ok := UserIDFromContext(ctx); ok {
+		query, args = query+" AND user_id = ?", append(args, userID)
+	}
+	var id int
+	err := store.conn().QueryRowContext(ctx, query, args...).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrTodoNotFound
+	}
+	return id, err
+}
+
+// ResolveKey is the InMemoryTodoStore version.
+func (s *InMemoryTodoStore) ResolveKey(ctx context.Context, key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.todos {
+		if t.ExternalID != nil && *t.ExternalID == key && visible(ctx, t) {
+			return t.ID, nil
+		}
+	}
+	return 0, ErrTodoNotFound
+}
+
+// resolveRef returns the id of the todo ref names, by its external ID or,
+// unless keysOnly, by its integer id. ok is false if ref is neither, and an
+// external ID the user has no todo with is ErrTodoNotFound.
+func resolveRef(ctx context.Context, store TodoStore, keysOnly bool, ref string) (id int, ok bool, err error) {
+	if key, err := validateExternalID(ref); err == nil {
+		id, err := store.ResolveKey(ctx, key)
+		return id, true, err
+	}
+	id, err = strconv.Atoi(ref)
+	if err != nil || id < 1 || keysOnly {
+		return 0, false, nil
+	}
+	return id, true, nil
+}
+
+// refKind describes the todo references resolveRef takes, for error
+// messages.
+func refKind(keysOnly bool) string {
+	if keysOnly {
+		return "a todo's UUID or ULID"
+	}
+	return "a todo id, UUID or ULID"
+}
+
+// todoRef is how todo is referred to in links: by its external ID if it has
+// one, and by its integer id otherwise.
+func todoRef(todo *Todo) string {
+	if todo.ExternalID != nil {
+		return *todo.ExternalID
+	}
+	return strconv.Itoa(todo.ID)
+}
+
+// keysOnlyStore wraps a TodoStore for the idUUID and idULID strategies. It
+// sets keysOnly on every todo it returns, so they are shown without their
+// integer id and name their parent by its external ID, and it does the same
+// to audit entries.
+type keysOnlyStore struct {
+	TodoStore
+}
+
+// markKeysOnly sets keysOnly on todos and their children, whose parentKey
+// is the todo's external ID.
+func markKeysOnly(todos ...*Todo) {
+	for _, todo := range todos {
+		if todo != nil {
+			todo.keysOnly = true
+			for _, child := range todo.Children {
+				child.parentKey = todo.ExternalID
+			}
+			markKeysOnly(todo.Children...)
+		}
+	}
+}
+
+// keysOf returns the external IDs of the todos with the given ids, leaving
+// out those the user can't see.
+func (s keysOnlyStore) keysOf(ctx context.Context, ids []int) (map[int]string, error) {
+	keys := make(map[int]string, len(ids))
+	if len(ids) == 0 {
+		return keys, nil
+	}
+	todos, err := s.TodoStore.GetByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, todo := range todos {
+		if todo.ExternalID != nil {
+			keys[todo.ID] = *todo.ExternalID
+		}
+	}
+	return keys, nil
+}
+
+// mark is markKeysOnly that also looks up the parentKey of subtasks among
+// todos, in one call for all of them.
+func (s keysOnlyStore) mark(ctx context.Context, todos ...*Todo) error {
+	var parents []int
+	for _, todo := range todos {
+		if todo != nil && todo.ParentID != nil {
+			parents = append(parents, *todo.ParentID)
+		}
+	}
+	keys, err := s.keysOf(ctx, parents)
+	if err != nil {
+		return err
+	}
+	for _, todo := range todos {
+		if todo != nil && todo.ParentID != nil {
+			if key, ok := keys[*todo.ParentID]; ok {
+				todo.parentKey = &key
+			}
+		}
+	}
+	markKeysOnly(todos...)
+	return nil
+}
+
+func (s keysOnlyStore) GetAll(ctx context.Context, opts ListOptions) ([]*Todo, error) {
+	todos, err := s.TodoStore.GetAll(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return todos, s.mark(ctx, todos...)
+}
+
+func (s keysOnlyStore) GetAllUnscoped(ctx context.Context, opts ListOptions) ([]*OwnedTodo, int, error) {
+	owned, total, err := s.TodoStore.GetAllUnscoped(ctx, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	todos := make([]*Todo, len(owned))
+	for i, todo := range owned {
+		todos[i] = todo.Todo
+	}
+	return owned, total, s.mark(ctx, todos...)
+}
+
+// ForEach leaves parent_id out rather than looking up a key per todo: the
+// CSV export it serves has no column for it.
+func (s keysOnlyStore) ForEach(ctx context.Context, filter TodoFilter, fn func(*Todo) error) error {
+	return s.TodoStore.ForEach(ctx, filter, func(todo *Todo) error {
+		markKeysOnly(todo)
+		return fn(todo)
+	})
+}
+
+func (s keysOnlyStore) GetByID(ctx context.Context, id int) (*Todo, error) {
+	todo, err := s.TodoStore.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return todo, s.mark(ctx, todo)
+}
+
+func (s keysOnlyStore) GetByIDs(ctx context.Context, ids []int) ([]*Todo, error) {
+	todos, err := s.TodoStore.GetByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	return todos, s.mark(ctx, todos...)
+}
+
+func (s keysOnlyStore) Create(ctx context.Context, todo *Todo) (*Todo, error) {
+	created, err := s.TodoStore.Create(ctx, todo)
+	if err != nil {
+		return nil, err
+	}
+	return created, s.mark(ctx, created)
+}
+
+func (s keysOnlyStore) CreateIdempotent(ctx context.Context, key string, todo *Todo) (*Todo, bool, error) {
+	created, replayed, err := s.TodoStore.CreateIdempotent(ctx, key, todo)
+	if err != nil {
+		return nil, replayed, err
+	}
+	return created, replayed, s.mark(ctx, created)
+}
+
+func (s keysOnlyStore) CreateBulk(ctx context.Context, todos []*Todo) ([]*Todo, error) {
+	created, err := s.TodoStore.CreateBulk(ctx, todos)
+	if err != nil {
+		return nil, err
+	}
+	return created, s.mark(ctx, created...)
+}
+
+func (s keysOnlyStore) ToggleCompleted(ctx context.Context, id int) (*Todo, error) {
+	todo, err := s.TodoStore.ToggleCompleted(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return todo, s.mark(ctx, todo)
+}
+
+func (s keysOnlyStore) Undo(ctx context.Context) (*Todo, error) {
+	todo, err := s.TodoStore.Undo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return todo, s.mark(ctx, todo)
+}
+
+func (s keysOnlyStore) GetChildren(ctx context.Context, id int) ([]*Todo, error) {
+	children, err := s.TodoStore.GetChildren(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return children, s.mark(ctx, children...)
+}
+
+// History leaves out the todo id, and shows a change of parent_id by the
+// parents' external IDs. The change is dropped if either parent can no
+// longer be looked up.
+func (s keysOnlyStore) History(ctx context.Context, id int) ([]*AuditEntry, error) {
+	entries, err := s.TodoStore.History(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var parents []int
+	for _, entry := range entries {
+		entry.TodoID = 0
+		if change, ok := entry.Diff["parent_id"]; ok {
+			for _, v := range []interface{}{change.From, change.To} {
+				if parent, ok := v.(float64); ok {
+					parents = append(parents, int(parent))
+				}
+			}
+		}
+	}
+	keys, err := s.keysOf(ctx, parents)
+	if err != nil {
+		return nil, err
+	}
+	// keyOf returns v, a parent_id from a diff, as the parent's key.
+	keyOf := func(v interface{}) (interface{}, bool) {
+		parent, ok := v.(float64)
+		if !ok {
+			return nil, true
+		}
+		key, ok := keys[int(parent)]
+		return key, ok
+	}
+	for _, entry := range entries {
+		change, ok := entry.Diff["parent_id"]
+		if !ok {
+			continue
+		}
+		from, fromOK := keyOf(change.From)
+		to, toOK := keyOf(change.To)
+		if fromOK && toOK {
+			entry.Diff["parent_id"] = fieldChange{From: from, To: to}
+		} else {
+			delete(entry.Diff, "parent_id")
+		}
+	}
+	return entries, nil
+}
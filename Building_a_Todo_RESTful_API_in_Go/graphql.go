@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+)
+
+// graphQLSchema is the schema served at POST /graphql. Every resolver goes
+// through the same TodoStore as the REST handlers, so validation, ownership
+// and not-found behave the same way; errors carry the REST error code in
+// extensions.code.
+const graphQLSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+scalar Time
+
+type Query {
+	# todos takes the filters of POST /todos/search.
+	todos(titleContains: String, completed: Boolean, priority: [String!], createdAfter: String, createdBefore: String, sort: String, order: String, limit: Int, offset: Int): TodoPage!
+	# todo and the mutations below pick a todo by id or by externalId, and
+	# only by externalId under ID_STRATEGY uuid and ulid.
+	todo(id: Int, externalId: String): Todo
+}
+
+type Mutation {
+	createTodo(input: CreateTodoInput!): Todo!
+	# updateTodo changes only the fields given; a null dueDate clears it.
+	updateTodo(id: Int, externalId: String, input: UpdateTodoInput!): Todo!
+	# deleteTodo returns the id of the todo deleted, or null under
+	# ID_STRATEGY uuid and ulid.
+	deleteTodo(id: Int, externalId: String): Int
+	toggleTodo(id: Int, externalId: String): Todo!
+}
+
+input CreateTodoInput {
+	title: String!
+	completed: Boolean
+	dueDate: Time
+	priority: String
+	recurrence: String
+	parentId: Int
+	# externalId is a UUID or ULID that makes retrying createTodo safe: a
+	# second call with the same one returns the todo the first created.
+	externalId: String
+}
+
+input UpdateTodoInput {
+	title: String
+	completed: Boolean
+	dueDate: Time
+	priority: String
+	recurrence: String
+}
+
+type TodoPage {
+	todos: [Todo!]!
+	total: Int!
+	limit: Int!
+	offset: Int!
+}
+
+type Todo {
+	# id is null under ID_STRATEGY uuid and ulid.
+	id: Int
+	title: String!
+	completed: Boolean!
+	archived: Boolean!
+	position: Int!
+	createdAt: Time!
+	updatedAt: Time!
+	dueDate: Time
+	priority: String!
+	recurrence: String!
+	parentId: Int
+	externalId: String
+	version: Int!
+	createdBy: String
+	updatedBy: String
+	tags: [String!]!
+	children: [Todo!]!
+}
+`
+
+// graphQLMaxDepth stops queries from nesting children without end.
+const graphQLMaxDepth = 10
+
+// graphQLRequest is the body of POST /graphql.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    map[string]interface{} `json:"extensions"`
+}
+
+// serveGraphQL serves POST /graphql. Results and resolver errors are
+// answered with 200, as GraphQL clients expect; only a body that isn't a
+// GraphQL request gets an error status.
+func serveGraphQL(store TodoStore, opts RouterOptions) http.HandlerFunc {
+	resolver := &graphQLResolver{store: store, pages: opts.Pages, keysOnly: isKeysOnly(opts.IDStrategy), readOnly: opts.ReadOnly}
+	schema := graphql.MustParseSchema(graphQLSchema, resolver, graphql.MaxDepth(graphQLMaxDepth))
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req graphQLRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Query == "" {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "query is required")
+			return
+		}
+		writeJSON(w, http.StatusOK, schema.Exec(r.Context(), req.Query, req.OperationName, req.Variables))
+	}
+}
+
+// graphQLError is a resolver error with the code the REST API would have
+// answered with.
+type graphQLError struct {
+	code    string
+	message string
+}
+
+func (e *graphQLError) Error() string { return e.message }
+
+func (e *graphQLError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+// graphQLErr maps a store error to the code and message its REST handler
+// would use.
+func graphQLErr(ctx context.Context, err error) error {
+	switch {
+	case IsValidationError(err):
+		return &graphQLError{"validation_error", err.Error()}
+	case IsNotFound(err):
+		return &graphQLError{"not_found", "todo not found"}
+	case errors.Is(err, ErrHasChildren):
+		return &graphQLError{"has_children", "todo has subtasks; delete them first"}
+	case errors.Is(err, ErrQuotaExceeded):
+		return &graphQLError{"quota_exceeded", err.Error()}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &graphQLError{"timeout", "request timed out"}
+	}
+	slog.ErrorContext(ctx, "graphql resolver failed", "error", err)
+	return &graphQLError{"internal_error", internalErrorMessage}
+}
+
+type graphQLResolver struct {
+	store TodoStore
+	pages PageSizes
+	// keysOnly refuses todos picked by id.
+	keysOnly bool
+	// readOnly refuses every mutation; queries still run.
+	readOnly bool
+}
+
+// writable returns the error every mutation answers with in readOnly mode.
+func (r *graphQLResolver) writable() error {
+	if r.readOnly {
+		return &graphQLError{"read_only", readOnlyMessage}
+	}
+	return nil
+}
+
+// todoRefArgs pick a todo by id or externalId.
+type todoRefArgs struct {
+	ID         *int32
+	ExternalID *string
+}
+
+// todoID returns the todo args pick: the one with externalId if it is
+// given, and the one with id otherwise.
+func (r *graphQLResolver) todoID(ctx context.Context, args todoRefArgs) (int, error) {
+	switch {
+	case args.ExternalID != nil:
+		key, err := validateExternalID(*args.ExternalID)
+		if err != nil {
+			return 0, err
+		}
+		return r.store.ResolveKey(ctx, key)
+	case r.keysOnly:
+		return 0, &ValidationError{Field: "externalId", Message: "is required"}
+	case args.ID == nil:
+		return 0, &ValidationError{Field: "id", Message: "or externalId is required"}
+	}
+	return int(*args.ID), nil
+}
+
+func (r *graphQLResolver) Todos(ctx context.Context, args struct {
+	TitleContains *string
+	Completed     *bool
+	Priority      *[]string
+	CreatedAfter  *string
+	CreatedBefore *string
+	Sort          *string
+	Order         *string
+	Limit         *int32
+	Offset        *int32
+}) (*todoPageResolver, error) {
+	req := searchRequest{Completed: args.Completed}
+	setIf(&req.TitleContains, args.TitleContains)
+	setIf(&req.CreatedAfter, args.CreatedAfter)
+	setIf(&req.CreatedBefore, args.CreatedBefore)
+	setIf(&req.Sort, args.Sort)
+	setIf(&req.Order, args.Order)
+	if args.Priority != nil {
+		req.Priorities = *args.Priority
+	}
+	if args.Limit != nil {
+		req.Limit = int(*args.Limit)
+	}
+	if args.Offset != nil {
+		req.Offset = int(*args.Offset)
+	}
+	opts, err := req.options(r.pages)
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	todos, err := r.store.GetAll(ctx, opts)
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	total, err := r.store.Count(ctx, opts.TodoFilter)
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	return &todoPageResolver{store: r.store, page: searchResult{Todos: todos, Total: total, Limit: opts.Limit, Offset: opts.Offset}}, nil
+}
+
+func setIf(dst *string, v *string) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// Todo answers null, not an error, for a todo that doesn't exist.
+func (r *graphQLResolver) Todo(ctx context.Context, args todoRefArgs) (*todoResolver, error) {
+	id, err := r.todoID(ctx, args)
+	if err == nil {
+		var todo *Todo
+		todo, err = r.store.GetByID(ctx, id)
+		if err == nil {
+			return r.todo(todo), nil
+		}
+	}
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	return nil, nil
+}
+
+func (r *graphQLResolver) CreateTodo(ctx context.Context, args struct {
+	Input struct {
+		Title      string
+		Completed  *bool
+		DueDate    *graphql.Time
+		Priority   *string
+		Recurrence *string
+		ParentID   *int32
+		ExternalID *string
+	}
+}) (*todoResolver, error) {
+	if err := r.writable(); err != nil {
+		return nil, err
+	}
+	in := args.Input
+	todo := &Todo{Title: in.Title}
+	if in.Completed != nil {
+		todo.Completed = *in.Completed
+	}
+	if in.DueDate != nil {
+		todo.DueDate = &in.DueDate.Time
+	}
+	setIf(&todo.Priority, in.Priority)
+	setIf(&todo.Recurrence, in.Recurrence)
+	if in.ParentID != nil {
+		// Picking the parent by id would let it be found by counting.
+		if r.keysOnly {
+			return nil, graphQLErr(ctx, &ValidationError{Field: "parentId", Message: "can't be used with external IDs"})
+		}
+		parentID := int(*in.ParentID)
+		todo.ParentID = &parentID
+	}
+	todo.ExternalID = in.ExternalID
+	created, err := r.store.Create(ctx, todo)
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	return r.todo(created), nil
+}
+
+// UpdateTodo applies the fields given through UpdateFields, the same path
+// PATCH /todos/{id} takes.
+func (r *graphQLResolver) UpdateTodo(ctx context.Context, args struct {
+	todoRefArgs
+	Input struct {
+		Title      *string
+		Completed  *bool
+		DueDate    graphql.NullTime
+		Priority   *string
+		Recurrence *string
+	}
+}) (*todoResolver, error) {
+	if err := r.writable(); err != nil {
+		return nil, err
+	}
+	in := args.Input
+	fields := make(map[string]interface{})
+	if in.Title != nil {
+		fields["title"] = *in.Title
+	}
+	if in.Completed != nil {
+		fields["completed"] = *in.Completed
+	}
+	if in.DueDate.Set {
+		fields["due_date"] = nil
+		if in.DueDate.Value != nil {
+			fields["due_date"] = in.DueDate.Value.Format(time.RFC3339Nano)
+		}
+	}
+	if in.Priority != nil {
+		fields["priority"] = *in.Priority
+	}
+	if in.Recurrence != nil {
+		fields["recurrence"] = *in.Recurrence
+	}
+	id, err := r.todoID(ctx, args.todoRefArgs)
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	if err := r.store.UpdateFields(ctx, id, fields); err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	todo, err := r.store.GetByID(ctx, id)
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	return r.todo(todo), nil
+}
+
+// DeleteTodo soft-deletes a todo, like DELETE /todos/{id}, and returns its
+// ID, which is left out with keysOnly.
+func (r *graphQLResolver) DeleteTodo(ctx context.Context, args todoRefArgs) (*int32, error) {
+	if err := r.writable(); err != nil {
+		return nil, err
+	}
+	id, err := r.todoID(ctx, args)
+	if err == nil {
+		err = r.store.Delete(ctx, id)
+	}
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	if r.keysOnly {
+		return nil, nil
+	}
+	deleted := int32(id)
+	return &deleted, nil
+}
+
+func (r *graphQLResolver) ToggleTodo(ctx context.Context, args todoRefArgs) (*todoResolver, error) {
+	if err := r.writable(); err != nil {
+		return nil, err
+	}
+	id, err := r.todoID(ctx, args)
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	todo, err := r.store.ToggleCompleted(ctx, id)
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	return r.todo(todo), nil
+}
+
+func (r *graphQLResolver) todo(t *Todo) *todoResolver {
+	return &todoResolver{store: r.store, t: t}
+}
+
+type todoPageResolver struct {
+	store TodoStore
+	page  searchResult
+}
+
+func (p *todoPageResolver) Todos() []*todoResolver {
+	out := make([]*todoResolver, len(p.page.Todos))
+	for i, t := range p.page.Todos {
+		out[i] = &todoResolver{store: p.store, t: t}
+	}
+	return out
+}
+
+func (p *todoPageResolver) Total() int32  { return int32(p.page.Total) }
+func (p *todoPageResolver) Limit() int32  { return int32(p.page.Limit) }
+func (p *todoPageResolver) Offset() int32 { return int32(p.page.Offset) }
+
+// todoResolver exposes a Todo. Tags and children are only looked up when a
+// query asks for them.
+type todoResolver struct {
+	store TodoStore
+	t     *Todo
+}
+
+func (r *todoResolver) Title() string           { return r.t.Title }
+func (r *todoResolver) Completed() bool         { return r.t.Completed }
+func (r *todoResolver) Archived() bool          { return r.t.Archived }
+func (r *todoResolver) Position() int32         { return int32(r.t.Position) }
+func (r *todoResolver) CreatedAt() graphql.Time { return graphql.Time{Time: r.t.CreatedAt} }
+func (r *todoResolver) UpdatedAt() graphql.Time { return graphql.Time{Time: r.t.UpdatedAt} }
+func (r *todoResolver) Priority() string        { return r.t.Priority }
+func (r *todoResolver) Recurrence() string      { return r.t.Recurrence }
+func (r *todoResolver) Version() int32          { return int32(r.t.Version) }
+func (r *todoResolver) CreatedBy() *string      { return r.t.CreatedBy }
+func (r *todoResolver) UpdatedBy() *string      { return r.t.UpdatedBy }
+func (r *todoResolver) ExternalID() *string     { return r.t.ExternalID }
+
+// ID is null for a todo from a keysOnlyStore.
+func (r *todoResolver) ID() *int32 {
+	if r.t.keysOnly {
+		return nil
+	}
+	id := int32(r.t.ID)
+	return &id
+}
+
+func (r *todoResolver) DueDate() *graphql.Time {
+	if r.t.DueDate == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *r.t.DueDate}
+}
+
+// ParentID is null for a todo from a keysOnlyStore, like ID.
+func (r *todoResolver) ParentID() *int32 {
+	if r.t.ParentID == nil || r.t.keysOnly {
+		return nil
+	}
+	id := int32(*r.t.ParentID)
+	return &id
+}
+
+func (r *todoResolver) Tags(ctx context.Context) ([]string, error) {
+	tags, err := r.store.GetTags(ctx, r.t.ID)
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	return tags, nil
+}
+
+func (r *todoResolver) Children(ctx context.Context) ([]*todoResolver, error) {
+	children, err := r.store.GetChildren(ctx, r.t.ID)
+	if err != nil {
+		return nil, graphQLErr(ctx, err)
+	}
+	out := make([]*todoResolver, len(children))
+	for i, t := range children {
+		out[i] = &todoResolver{store: r.store, t: t}
+	}
+	return out, nil
+}
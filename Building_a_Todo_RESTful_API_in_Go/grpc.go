@@ -0,0 +1,384 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative todo.proto
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCOptions are the settings the gRPC server shares with the HTTP one.
+type GRPCOptions struct {
+	APIKeys        []string
+	JWTSecret      []byte
+	RequestTimeout time.Duration
+	Pages          PageSizes
+	// ReadOnly refuses every call but List and Get with Unavailable.
+	ReadOnly bool
+	// IDStrategy is one of idStrategies. Under idUUID and idULID, todos are
+	// picked and shown by external_id alone, as on the HTTP API.
+	IDStrategy string
+}
+
+// NewGRPCServer serves TodoService backed by store. Calls are authenticated,
+// time-limited and logged like HTTP requests, and their changes are
+// published on events.
+func NewGRPCServer(store TodoStore, events *broker, opts GRPCOptions, logger *slog.Logger) *grpc.Server {
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		grpcLogger(logger),
+		grpcRecover(logger),
+		grpcAuth(opts.APIKeys, opts.JWTSecret),
+		grpcReadOnly(opts.ReadOnly),
+		grpcTimeout(opts.RequestTimeout),
+	))
+	keysOnly := isKeysOnly(opts.IDStrategy)
+	if keysOnly {
+		store = keysOnlyStore{store}
+	}
+	RegisterTodoServiceServer(srv, &todoService{
+		store:    &publishingStore{TodoStore: store, broker: events, keysOnly: keysOnly},
+		pages:    opts.Pages,
+		keysOnly: keysOnly,
+	})
+	return srv
+}
+
+func grpcLogger(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		level := slog.LevelInfo
+		if status.Code(err) == codes.Internal || status.Code(err) == codes.Unknown {
+			level = slog.LevelError
+		}
+		attrs := []interface{}{"method", info.FullMethod, "code", status.Code(err).String(), "duration", time.Since(start)}
+		if err != nil {
+			attrs = append(attrs, "error", err)
+		}
+		logger.Log(ctx, level, "grpc", attrs...)
+		return resp, err
+	}
+}
+
+// grpcRecover turns a panic in a handler into an Internal error instead of
+// taking the process down, as recoverPanics does for HTTP.
+func grpcRecover(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				logger.ErrorContext(ctx, "panic serving grpc call", "method", info.FullMethod, "panic", v, "stack", string(debug.Stack()))
+				err = status.Error(codes.Internal, "internal error")
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// grpcAuth checks the x-api-key and authorization metadata the way
+// requireAPIKey and requireJWT check the HTTP headers.
+func grpcAuth(keys []string, secret []byte) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		first := func(key string) string {
+			if v := md.Get(key); len(v) > 0 {
+				return v[0]
+			}
+			return ""
+		}
+		if len(keys) > 0 && !validAPIKey(keys, first("x-api-key")) {
+			return nil, status.Error(codes.Unauthenticated, "missing or invalid API key")
+		}
+		if len(secret) > 0 {
+			raw, ok := strings.CutPrefix(first("authorization"), "Bearer ")
+			if !ok || raw == "" {
+				return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+			}
+			userID, err := tokenSubject(secret, raw)
+			if err != nil {
+				return nil, status.Error(codes.Unauthenticated, err.Error())
+			}
+			ctx = WithUserID(ctx, userID)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// grpcReadMethods are the TodoService calls that don't write, the ones
+// grpcReadOnly lets through.
+var grpcReadMethods = []string{TodoService_List_FullMethodName, TodoService_Get_FullMethodName}
+
+// grpcReadOnly, when enabled, refuses every call that isn't in
+// grpcReadMethods with Unavailable, as readOnly does for HTTP writes.
+func grpcReadOnly(enabled bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if enabled && !contains(grpcReadMethods, info.FullMethod) {
+			return nil, status.Error(codes.Unavailable, readOnlyMessage)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// grpcTimeout caps each call like withTimeout caps HTTP requests, keeping
+// any shorter deadline the client set.
+func grpcTimeout(d time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if d <= 0 {
+			return handler(ctx, req)
+		}
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// grpcError maps a store error to the status its REST handler's HTTP code
+// corresponds to.
+func grpcError(err error) error {
+	switch {
+	case IsValidationError(err):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case IsNotFound(err):
+		return status.Error(codes.NotFound, "todo not found")
+	case errors.Is(err, ErrHasChildren):
+		return status.Error(codes.FailedPrecondition, "todo has subtasks; delete them first")
+	case errors.Is(err, ErrQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrVersionConflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "request timed out")
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "request cancelled")
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+type todoService struct {
+	UnimplementedTodoServiceServer
+	store TodoStore
+	pages PageSizes
+	// keysOnly refuses requests that pick a todo by id.
+	keysOnly bool
+}
+
+func (s *todoService) List(ctx context.Context, req *ListTodosRequest) (*ListTodosResponse, error) {
+	search := searchRequest{
+		TitleContains: req.GetTitleContains(),
+		Priorities:    req.GetPriority(),
+		Sort:          req.GetSort(),
+		Order:         req.GetOrder(),
+		Limit:         int(req.GetLimit()),
+		Offset:        int(req.GetOffset()),
+	}
+	if req.Completed != nil {
+		completed := req.GetCompleted()
+		search.Completed = &completed
+	}
+	if req.CreatedAfter != nil {
+		search.CreatedAfter = req.GetCreatedAfter().AsTime().Format(time.RFC3339Nano)
+	}
+	if req.CreatedBefore != nil {
+		search.CreatedBefore = req.GetCreatedBefore().AsTime().Format(time.RFC3339Nano)
+	}
+	opts, err := search.options(s.pages)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	todos, err := s.store.GetAll(ctx, opts)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	total, err := s.store.Count(ctx, opts.TodoFilter)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &ListTodosResponse{Total: int32(total), Limit: int32(opts.Limit), Offset: int32(opts.Offset)}
+	for _, todo := range todos {
+		resp.Todos = append(resp.Todos, todoItem(todo))
+	}
+	return resp, nil
+}
+
+// todoID returns the todo a request picks: the one with external ID key if
+// it is set, and the one with id otherwise. With keysOnly, key is required.
+func (s *todoService) todoID(ctx context.Context, id int64, key string) (int, error) {
+	if key == "" && s.keysOnly {
+		return 0, &ValidationError{Field: "external_id", Message: "is required"}
+	}
+	if key == "" {
+		return int(id), nil
+	}
+	key, err := validateExternalID(key)
+	if err != nil {
+		return 0, err
+	}
+	return s.store.ResolveKey(ctx, key)
+}
+
+func (s *todoService) Get(ctx context.Context, req *GetTodoRequest) (*TodoItem, error) {
+	id, err := s.todoID(ctx, req.GetId(), req.GetExternalId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	todo, err := s.store.GetByID(ctx, id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return todoItem(todo), nil
+}
+
+func (s *todoService) Create(ctx context.Context, req *CreateTodoRequest) (*TodoItem, error) {
+	todo := &Todo{
+		Title:      req.GetTitle(),
+		Completed:  req.GetCompleted(),
+		Priority:   req.GetPriority(),
+		Recurrence: req.GetRecurrence(),
+	}
+	if req.DueDate != nil {
+		due := req.GetDueDate().AsTime()
+		todo.DueDate = &due
+	}
+	if req.ParentId != nil {
+		// Picking the parent by id would let it be found by counting.
+		if s.keysOnly {
+			return nil, grpcError(&ValidationError{Field: "parent_id", Message: "can't be used with external IDs"})
+		}
+		parentID := int(req.GetParentId())
+		todo.ParentID = &parentID
+	}
+	if req.ExternalId != nil {
+		externalID := req.GetExternalId()
+		todo.ExternalID = &externalID
+	}
+	created, err := s.store.Create(ctx, todo)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return todoItem(created), nil
+}
+
+// Update goes through UpdateFields, the same path PATCH /todos/{id} takes,
+// so only the fields set in req change. With a version it merges them into
+// the todo instead and saves that pinned to the version, like PUT.
+func (s *todoService) Update(ctx context.Context, req *UpdateTodoRequest) (*TodoItem, error) {
+	fields := make(map[string]interface{})
+	if req.Title != nil {
+		fields["title"] = req.GetTitle()
+	}
+	if req.Completed != nil {
+		fields["completed"] = req.GetCompleted()
+	}
+	if req.GetClearDueDate() {
+		fields["due_date"] = nil
+	} else if req.DueDate != nil {
+		fields["due_date"] = req.GetDueDate().AsTime().Format(time.RFC3339Nano)
+	}
+	if req.Priority != nil {
+		fields["priority"] = req.GetPriority()
+	}
+	if req.Recurrence != nil {
+		fields["recurrence"] = req.GetRecurrence()
+	}
+	id, err := s.todoID(ctx, req.GetId(), req.GetExternalId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if req.GetVersion() != 0 {
+		err = s.updateVersion(ctx, id, int(req.GetVersion()), fields)
+	} else {
+		err = s.store.UpdateFields(ctx, id, fields)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	todo, err := s.store.GetByID(ctx, id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return todoItem(todo), nil
+}
+
+// updateVersion applies fields to todo id if it is still at version, and
+// returns ErrVersionConflict otherwise.
+func (s *todoService) updateVersion(ctx context.Context, id, version int, fields map[string]interface{}) error {
+	current, err := s.store.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	merged, err := mergePatch(current, fields)
+	if err != nil {
+		return err
+	}
+	merged.Version = version
+	return s.store.Update(ctx, merged)
+}
+
+func (s *todoService) Delete(ctx context.Context, req *DeleteTodoRequest) (*DeleteTodoResponse, error) {
+	id, err := s.todoID(ctx, req.GetId(), req.GetExternalId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if req.GetPermanent() {
+		err = s.store.HardDelete(ctx, id)
+	} else {
+		err = s.store.Delete(ctx, id)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &DeleteTodoResponse{}, nil
+}
+
+// todoItem converts todo for a response. A todo from a keysOnlyStore is
+// left without its id and parent_id.
+func todoItem(todo *Todo) *TodoItem {
+	item := &TodoItem{
+		Id:         int64(todo.ID),
+		Title:      todo.Title,
+		Completed:  todo.Completed,
+		Archived:   todo.Archived,
+		Position:   int32(todo.Position),
+		CreatedAt:  timestamppb.New(todo.CreatedAt),
+		UpdatedAt:  timestamppb.New(todo.UpdatedAt),
+		Priority:   todo.Priority,
+		Recurrence: todo.Recurrence,
+		Version:    int32(todo.Version),
+		ExternalId: todo.ExternalID,
+	}
+	if todo.keysOnly {
+		item.Id = 0
+	}
+	if todo.DueDate != nil {
+		item.DueDate = timestamppb.New(*todo.DueDate)
+	}
+	if todo.ParentID != nil && !todo.keysOnly {
+		parentID := int64(*todo.ParentID)
+		item.ParentId = &parentID
+	}
+	return item
+}
+
+// stopGRPC lets calls in flight finish, like http.Server.Shutdown, and cuts
+// off whatever is left once ctx is done.
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCExternalID(t *testing.T) {
+	ctx := context.Background()
+	svc := &todoService{store: NewInMemoryTodoStore()}
+	key := "01ARZ3NDEKTSV4RRFFQ69G5FAV"
+	created, err := svc.Create(ctx, &CreateTodoRequest{Title: "a", ExternalId: &key})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if created.GetExternalId() != key {
+		t.Errorf("Create external_id = %q, want %q", created.GetExternalId(), key)
+	}
+	retried, err := svc.Create(ctx, &CreateTodoRequest{Title: "a", ExternalId: &key})
+	if err != nil || retried.GetId() != created.GetId() {
+		t.Errorf("retried Create = %v, %v; want todo %d again", retried, err, created.GetId())
+	}
+	got, err := svc.Get(ctx, &GetTodoRequest{ExternalId: key})
+	if err != nil || got.GetId() != created.GetId() {
+		t.Errorf("Get by external_id = %v, %v; want todo %d", got, err, created.GetId())
+	}
+	title := "b"
+	_, err = svc.Update(ctx, &UpdateTodoRequest{ExternalId: key, Title: &title, Version: created.GetVersion() + 1})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("Update with a stale version: %v, want Aborted", err)
+	}
+	updated, err := svc.Update(ctx, &UpdateTodoRequest{ExternalId: key, Title: &title, Version: created.GetVersion()})
+	if err != nil || updated.GetTitle() != title {
+		t.Errorf("Update = %v, %v; want title %q", updated, err, title)
+	}
+}
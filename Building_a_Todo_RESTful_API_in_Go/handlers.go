@@ -0,0 +1,919 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDateParam parses an RFC3339 timestamp or a date, which stands for
+// midnight UTC.
+func parseDateParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
+
+// parseListOptions reads limit, offset or after, filters and sorting from
+// the query string. Missing or invalid paging values fall back to the
+// defaults and out-of-range values are clamped to pages; invalid filter or
+// sort values are reported as an error.
+func parseListOptions(r *http.Request, pages PageSizes) (ListOptions, error) {
+	pages = pages.withDefaults()
+	opts := ListOptions{Limit: pages.Default, Sort: "position", Order: "asc"}
+	q := r.URL.Query()
+	if v := q.Get("sort"); v != "" {
+		if !contains(sortColumns, v) {
+			return opts, fmt.Errorf("invalid sort value %q: must be one of %s", v, strings.Join(sortColumns, ", "))
+		}
+		opts.Sort = v
+	}
+	if v := q.Get("order"); v != "" {
+		v = strings.ToLower(v)
+		if v != "asc" && v != "desc" {
+			return opts, fmt.Errorf("invalid order value %q: must be asc or desc", q.Get("order"))
+		}
+		opts.Order = v
+	}
+	if v := q.Get("completed"); v != "" {
+		var completed bool
+		switch v {
+		case "true":
+			completed = true
+		case "false":
+			completed = false
+		default:
+			return opts, fmt.Errorf("invalid completed value %q: must be true or false", v)
+		}
+		opts.Completed = &completed
+	}
+	if v := q.Get("recurring"); v != "" {
+		recurring, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid recurring value %q: must be true or false", v)
+		}
+		opts.Recurring = &recurring
+	}
+	if v := q.Get("overdue"); v != "" {
+		overdue, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid overdue value %q: must be true or false", v)
+		}
+		// The most overdue come first. A todo falling overdue between two
+		// page requests sorts after every one already seen, so it doesn't
+		// shift the pages before it.
+		opts.Overdue, opts.OverdueAt = &overdue, time.Now().UTC()
+		if overdue && !q.Has("sort") {
+			opts.Sort = "due_date"
+		}
+	}
+	if v := q.Get("archived"); v != "" {
+		archived, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid archived value %q: must be true or false", v)
+		}
+		opts.Archived = archived
+	}
+	if v := q.Get("created_after"); v != "" {
+		after, err := parseDateParam(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid created_after value %q: must be an RFC3339 timestamp or a YYYY-MM-DD date", v)
+		}
+		opts.CreatedAfter = &after
+	}
+	if v := q.Get("created_before"); v != "" {
+		before, err := parseDateParam(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid created_before value %q: must be an RFC3339 timestamp or a YYYY-MM-DD date", v)
+		}
+		opts.CreatedBefore = &before
+	}
+	if opts.CreatedAfter != nil && opts.CreatedBefore != nil && !opts.CreatedAfter.Before(*opts.CreatedBefore) {
+		return opts, fmt.Errorf("created_after must be before created_before")
+	}
+	opts.Query = normalizeTitle(q.Get("q"))
+	opts.Tag = normalizeTag(q.Get("tag"))
+	if v := q.Get("include_deleted"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid include_deleted value %q: must be true or false", v)
+		}
+		opts.IncludeDeleted = include
+	}
+	if v := q.Get("priority"); v != "" {
+		if !contains(priorities, v) {
+			return opts, fmt.Errorf("invalid priority value %q: must be one of %s", v, strings.Join(priorities, ", "))
+		}
+		opts.Priority = v
+	}
+	if v := q.Get("fields"); v != "" {
+		for _, field := range splitList(v) {
+			if _, ok := todoFields[field]; !ok {
+				return opts, fmt.Errorf("invalid fields value %q: must be a comma-separated list of %s", field, todoFieldNames())
+			}
+			if !contains(opts.Fields, field) {
+				opts.Fields = append(opts.Fields, field)
+			}
+		}
+	}
+	if limit, err := strconv.Atoi(q.Get("limit")); err == nil {
+		opts.Limit = limit
+	}
+	if offset, err := strconv.Atoi(q.Get("offset")); err == nil {
+		opts.Offset = offset
+	}
+	if v := q.Get("after"); v != "" {
+		after, err := strconv.Atoi(v)
+		if err != nil || after < 0 {
+			return opts, fmt.Errorf("invalid after value %q: must be a todo id", v)
+		}
+		if (q.Has("sort") && opts.Sort != "id") || (q.Has("order") && opts.Order != "asc") || q.Has("offset") {
+			return opts, fmt.Errorf("after can't be combined with offset or with any order other than ascending id")
+		}
+		opts.After, opts.Sort, opts.Order = after, "id", "asc"
+	}
+	opts.Limit = pages.clamp(opts.Limit)
+	if opts.Offset < 0 {
+		opts.Offset = 0
+	}
+	return opts, nil
+}
+
+// errorBody is the JSON envelope every error response is wrapped in.
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+// errorDetail carries a machine-readable code clients can branch on and a
+// human-readable message.
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details lists each invalid field when a body fails its schema.
+	Details []fieldError `json:"details,omitempty"`
+}
+
+// writeJSON replies with status and v encoded as JSON. v is marshaled before
+// anything is written so an encoding failure can still become a 500.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// writeJSONError replies with status and a JSON error envelope.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{Error: errorDetail{Code: code, Message: message}})
+}
+
+// internalErrorMessage is all a client is told about an internal error; the
+// error itself can hold SQL or file paths and only goes to the log.
+const internalErrorMessage = "internal server error"
+
+// writeInternalError replies with a 500 for an unexpected store error, or a
+// 503 if the request ran out of time before the store could answer. err is
+// recorded for the request's log line, which carries its request ID.
+func writeInternalError(w http.ResponseWriter, err error) {
+	recordError(w, err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeJSONError(w, http.StatusServiceUnavailable, "timeout", "request timed out")
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, "internal_error", internalErrorMessage)
+}
+
+// writeNotFound replies with a 404 for a todo that does not exist.
+func writeNotFound(w http.ResponseWriter) {
+	writeJSONError(w, http.StatusNotFound, "not_found", "todo not found")
+}
+
+// writeValidationError replies with a 422 describing invalid todo input,
+// with one entry in details per invalid field.
+func writeValidationError(w http.ResponseWriter, err error) {
+	errs := validationErrors(err)
+	details := make([]fieldError, len(errs))
+	for i, e := range errs {
+		details[i] = fieldError{Field: e.Field, Message: e.Message}
+	}
+	writeFieldErrors(w, err.Error(), details)
+}
+
+// checkStrictDue enforces ?strict_due=true, which create, PUT and PATCH take
+// to refuse a due date that has already passed; without it any date goes.
+// On failure it writes the error response and returns false.
+func checkStrictDue(w http.ResponseWriter, r *http.Request, due *time.Time) bool {
+	v := r.URL.Query().Get("strict_due")
+	if v == "" {
+		return true
+	}
+	strict, err := strconv.ParseBool(v)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("invalid strict_due value %q: must be true or false", v))
+		return false
+	}
+	if strict && due != nil && due.Before(time.Now().UTC()) {
+		writeValidationError(w, &ValidationError{Field: "due_date", Message: "must not be in the past"})
+		return false
+	}
+	return true
+}
+
+// patchDueDate returns the due date a PATCH body sets, or nil if it leaves
+// it alone, clears it or doesn't parse; UpdateFields reports the last case.
+func patchDueDate(fields map[string]interface{}) *time.Time {
+	v, ok := fields["due_date"]
+	if !ok {
+		return nil
+	}
+	due, err := patchColumns["due_date"](v)
+	if t, ok := due.(time.Time); ok && err == nil {
+		return &t
+	}
+	return nil
+}
+
+// writeFieldErrors replies with a 422 listing each invalid field of a body.
+func writeFieldErrors(w http.ResponseWriter, message string, errs []fieldError) {
+	writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: errorDetail{Code: "validation_error", Message: message, Details: errs}})
+}
+
+// decodeJSON decodes the request body into v, rejecting fields v doesn't
+// have. On failure it writes the error response and returns false: 413 when
+// the body is over the size limit, 422 for a wrongly typed or unknown field
+// and 400 for anything else.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeTooLarge(w, tooLarge)
+		return false
+	}
+	if err != nil {
+		writeDecodeError(w, err)
+		return false
+	}
+	return true
+}
+
+// writeDecodeError turns an encoding/json error into a response a client can
+// act on: a value of the wrong type or an unknown field is reported as a 422
+// validation error naming the field, anything else as a 400 for malformed
+// JSON.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "body"
+		}
+		fe := fieldError{Field: field, Message: fmt.Sprintf("got %s, want %s", typeErr.Value, jsonTypeName(typeErr.Type))}
+		writeFieldErrors(w, field+": "+fe.Message, []fieldError{fe})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for this one.
+		name, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		writeFieldErrors(w, name+": is not a known field", []fieldError{{Field: name, Message: "is not a known field"}})
+	case errors.As(err, &syntaxErr):
+		writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("malformed JSON at byte %d: %s", syntaxErr.Offset, syntaxErr))
+	case errors.Is(err, io.EOF):
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "request body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "malformed JSON: request body ends in the middle of a value")
+	default:
+		writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+	}
+}
+
+// jsonTypeName names the JSON type that decodes into t, in the words the
+// request schemas use.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return t.String()
+}
+
+func writeTooLarge(w http.ResponseWriter, err *http.MaxBytesError) {
+	writeJSONError(w, http.StatusRequestEntityTooLarge, "request_too_large",
+		fmt.Sprintf("request body must not exceed %d bytes", err.Limit))
+}
+
+// pathID reads the {id} path segment. If it isn't a positive integer it
+// writes a 400 invalid_id response and returns false.
+func pathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_id", "id must be a positive integer")
+		return 0, false
+	}
+	return id, true
+}
+
+// listTodos serves GET /todos. A limit above pages.Max is capped, and the
+// response then carries X-Limit-Clamped with the limit used.
+func listTodos(store TodoStore, pages PageSizes, keysOnly bool) http.HandlerFunc {
+	pages = pages.withDefaults()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("ids") {
+			listTodosByID(w, r, store, pages, keysOnly)
+			return
+		}
+		opts, err := parseListOptions(r, pages)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > pages.Max {
+			w.Header().Set("X-Limit-Clamped", strconv.Itoa(pages.Max))
+		}
+		var envelope bool
+		if v := r.URL.Query().Get("envelope"); v != "" {
+			if envelope, err = strconv.ParseBool(v); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("invalid envelope value %q: must be true or false", v))
+				return
+			}
+		}
+		todos, err := store.GetAll(r.Context(), opts)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		total, err := store.Count(r.Context(), opts.TodoFilter)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		// A full page under ?after= may have more behind it.
+		if r.URL.Query().Has("after") && len(todos) == opts.Limit {
+			w.Header().Set("Link", nextPageLink(r, todos[len(todos)-1]))
+		}
+		etag := listETag(todos, total)
+		w.Header().Set("ETag", etag)
+		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatchesWeak(ifNoneMatch, etag) {
+			w.Header().Add("Vary", "Accept")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		var body interface{} = todoList(todos)
+		if len(opts.Fields) > 0 {
+			body = sparseList(todos, opts.Fields)
+		}
+		if envelope {
+			if todos == nil {
+				body = todoList{}
+			}
+			body = todoPage{Data: body, Page: pageInfo{Limit: opts.Limit, Offset: opts.Offset, Total: total}}
+		}
+		writeResponse(w, r, http.StatusOK, body)
+	}
+}
+
+// listTodosByID serves GET /todos?ids=1,2,3: the todos with those IDs, in
+// that order, fetched in one query. Each may be an integer id or an external
+// ID, and only the latter with keysOnly. IDs that don't exist are left out.
+// The other list parameters don't apply.
+func listTodosByID(w http.ResponseWriter, r *http.Request, store TodoStore, pages PageSizes, keysOnly bool) {
+	refs := splitList(r.URL.Query().Get("ids"))
+	if len(refs) == 0 || len(refs) > pages.Max {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("ids must list between 1 and %d todo ids", pages.Max))
+		return
+	}
+	ids := make([]int, 0, len(refs))
+	for _, v := range refs {
+		id, ok, err := resolveRef(r.Context(), store, keysOnly, v)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("invalid ids value %q: must be %s", v, refKind(keysOnly)))
+			return
+		}
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	todos, err := store.GetByIDs(r.Context(), ids)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(todos)))
+	writeTodos(w, r, http.StatusOK, todos)
+}
+
+// nextPageLink builds the Link header pointing at the page after last,
+// keeping the rest of the request's query.
+func nextPageLink(r *http.Request, last *Todo) string {
+	q := r.URL.Query()
+	q.Set("after", todoRef(last))
+	next := url.URL{Path: BasePathFromContext(r.Context()) + r.URL.Path, RawQuery: q.Encode()}
+	return "<" + next.String() + `>; rel="next"`
+}
+
+// countTodos serves GET /todos/count: how many todos match the filters
+// GET /todos takes, without fetching them. Paging parameters are ignored.
+func countTodos(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseListOptions(r, PageSizes{})
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		count, err := store.Count(r.Context(), opts.TodoFilter)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"count": count})
+	}
+}
+
+func todoStats(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := store.Stats(r.Context())
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
+
+// createTodo honours an Idempotency-Key header: a retried request with the
+// same key gets the todo the first one created, marked with
+// Idempotent-Replayed, instead of a duplicate.
+func createTodo(store TodoStore, keysOnly bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body todoInput
+		if !decodeValidJSON(w, r, todoSchema, &body) {
+			return
+		}
+		if !checkStrictDue(w, r, body.DueDate) {
+			return
+		}
+		input, err := body.todo(r.Context(), store, keysOnly)
+		var todo *Todo
+		if err == nil {
+			if key := r.Header.Get("Idempotency-Key"); key != "" {
+				var replayed bool
+				todo, replayed, err = store.CreateIdempotent(r.Context(), key, input)
+				if replayed {
+					w.Header().Set("Idempotent-Replayed", "true")
+				}
+			} else {
+				todo, err = store.Create(r.Context(), input)
+			}
+		}
+		if IsValidationError(err) {
+			writeValidationError(w, err)
+			return
+		}
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if errors.Is(err, ErrIdempotencyConflict) {
+			writeJSONError(w, http.StatusConflict, "idempotency_conflict", err.Error())
+			return
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			writeJSONError(w, http.StatusConflict, "quota_exceeded", err.Error())
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		// The path the todo was posted to, so a client of /v1/todos is
+		// sent to /v1/todos/{id}, by its external ID if it has one.
+		w.Header().Set("Location", BasePathFromContext(r.Context())+r.URL.Path+"/"+todoRef(todo))
+		writeTodo(w, r, http.StatusCreated, todo)
+	}
+}
+
+func createTodos(store TodoStore, keysOnly bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body []*todoInput
+		if !decodeJSON(w, r, &body) {
+			return
+		}
+		input, err := todoInputs(r.Context(), store, keysOnly, body)
+		var todos []*Todo
+		if err == nil {
+			todos, err = store.CreateBulk(r.Context(), input)
+		}
+		if IsValidationError(err) {
+			writeValidationError(w, err)
+			return
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			writeJSONError(w, http.StatusConflict, "quota_exceeded", err.Error())
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeTodos(w, r, http.StatusCreated, todos)
+	}
+}
+
+func getTodo(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		todo, err := store.GetByID(r.Context(), id)
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		// ?include= takes a comma-separated list, e.g. include=tags,children.
+		include := splitList(r.URL.Query().Get("include"))
+		if contains(include, "tags") {
+			if todo.Tags, err = store.GetTags(r.Context(), id); err != nil {
+				writeInternalError(w, err)
+				return
+			}
+		}
+		if contains(include, "children") {
+			if todo.Children, err = store.GetChildren(r.Context(), id); err != nil {
+				writeInternalError(w, err)
+				return
+			}
+		}
+		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatchesWeak(ifNoneMatch, todoETag(todo)) {
+			w.Header().Set("ETag", todoETag(todo))
+			w.Header().Add("Vary", "Accept")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeTodo(w, r, http.StatusOK, todo)
+	}
+}
+
+func updateTodo(store TodoStore, keysOnly bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		var body todoInput
+		if !decodeValidJSON(w, r, todoSchema, &body) {
+			return
+		}
+		if !checkStrictDue(w, r, body.DueDate) {
+			return
+		}
+		// parent_id is checked like on create, though Update leaves it as
+		// it is.
+		todo, err := body.todo(r.Context(), store, keysOnly)
+		if IsValidationError(err) {
+			writeValidationError(w, err)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		todo.ID = id
+		current, ok := checkIfMatch(w, r, store, id)
+		if !ok {
+			return
+		}
+		if current != nil {
+			// Pin the update to the version the ETag was computed from, so a
+			// change landing after the check still can't be overwritten.
+			todo.Version = current.Version
+		}
+		err = store.Update(r.Context(), todo)
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if errors.Is(err, ErrVersionConflict) && current != nil {
+			writeJSONError(w, http.StatusPreconditionFailed, "precondition_failed", "todo has changed since the given ETag")
+			return
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			writeJSONError(w, http.StatusConflict, "version_conflict", err.Error())
+			return
+		}
+		if IsValidationError(err) {
+			writeValidationError(w, err)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		updated, err := store.GetByID(r.Context(), id)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeTodo(w, r, http.StatusOK, updated)
+	}
+}
+
+// patchTodo serves PATCH /todos/{id}, whose body is a JSON Merge Patch: it
+// is merged into the current todo and the result saved, pinned to the
+// version it was merged into. With If-Match a change landing in between
+// fails the request with 412; without, the patch is merged into the newer
+// todo instead, up to maxMergeAttempts times.
+func patchTodo(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		if !checkPatchType(w, r) {
+			return
+		}
+		var fields map[string]interface{}
+		if !decodeValidJSON(w, r, todoPatchSchema, &fields) {
+			return
+		}
+		if !checkStrictDue(w, r, patchDueDate(fields)) {
+			return
+		}
+		ifMatch := r.Header.Get("If-Match")
+		for attempt := 1; ; attempt++ {
+			current, err := store.GetByID(r.Context(), id)
+			if IsNotFound(err) {
+				writeNotFound(w)
+				return
+			}
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			if ifMatch != "" && !etagMatches(ifMatch, todoETag(current)) {
+				writeJSONError(w, http.StatusPreconditionFailed, "precondition_failed", "todo has changed since the given ETag")
+				return
+			}
+			if len(fields) == 0 {
+				writeTodo(w, r, http.StatusOK, current)
+				return
+			}
+			merged, err := mergePatch(current, fields)
+			if err != nil {
+				writeValidationError(w, err)
+				return
+			}
+			err = store.Update(r.Context(), merged)
+			if errors.Is(err, ErrVersionConflict) && ifMatch == "" && attempt < maxMergeAttempts {
+				continue
+			}
+			switch {
+			case IsNotFound(err):
+				writeNotFound(w)
+			case errors.Is(err, ErrVersionConflict) && ifMatch != "":
+				writeJSONError(w, http.StatusPreconditionFailed, "precondition_failed", "todo has changed since the given ETag")
+			case errors.Is(err, ErrVersionConflict):
+				writeJSONError(w, http.StatusConflict, "version_conflict", "todo kept changing while the patch was applied; try again")
+			case IsValidationError(err):
+				writeValidationError(w, err)
+			case err != nil:
+				writeInternalError(w, err)
+			default:
+				updated, err := store.GetByID(r.Context(), id)
+				if err != nil {
+					writeInternalError(w, err)
+					return
+				}
+				writeTodo(w, r, http.StatusOK, updated)
+			}
+			return
+		}
+	}
+}
+
+func deleteTodo(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		// ?permanent=true skips the soft delete and removes the row for good.
+		var err error
+		if r.URL.Query().Get("permanent") == "true" {
+			err = store.HardDelete(r.Context(), id)
+		} else {
+			err = store.Delete(r.Context(), id)
+		}
+		if errors.Is(err, ErrHasChildren) {
+			writeJSONError(w, http.StatusConflict, "has_children", "todo has subtasks; delete them first")
+			return
+		}
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+	}
+}
+
+// clearCompleted removes every completed todo, like TodoMVC's "clear
+// completed" button, and reports how many went.
+func clearCompleted(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := store.DeleteCompleted(r.Context())
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Deleted int `json:"deleted"`
+		}{n})
+	}
+}
+
+// maxBulkDelete bounds the IDs one bulk delete takes, keeping its statement
+// well under the databases' limits on bound parameters.
+const maxBulkDelete = 1000
+
+// deleteTodos serves POST /todos/bulk-delete, which soft-deletes the todos
+// listed in {"ids": [...]} together and reports how many went. Each entry is
+// an integer id or an external ID string, and only the latter with keysOnly.
+// IDs that don't match a deletable todo are skipped rather than failing the
+// request.
+func deleteTodos(store TodoStore, keysOnly bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			IDs []json.RawMessage `json:"ids"`
+		}
+		if !decodeJSON(w, r, &input) {
+			return
+		}
+		if input.IDs == nil {
+			writeValidationError(w, &ValidationError{Field: "ids", Message: "is required"})
+			return
+		}
+		if len(input.IDs) > maxBulkDelete {
+			writeValidationError(w, &ValidationError{Field: "ids", Message: fmt.Sprintf("must list at most %d todo ids", maxBulkDelete)})
+			return
+		}
+		var errs ValidationErrors
+		ids := make([]int, 0, len(input.IDs))
+		for i, raw := range input.IDs {
+			// A string holds an external ID; anything else is read as is.
+			ref := string(raw)
+			json.Unmarshal(raw, &ref)
+			id, ok, err := resolveRef(r.Context(), store, keysOnly, ref)
+			if !ok {
+				errs.add(&ValidationError{Field: fmt.Sprintf("ids[%d]", i), Message: "must be " + refKind(keysOnly)})
+				continue
+			}
+			if IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			ids = append(ids, id)
+		}
+		if err := errs.err(); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		n, err := store.DeleteMany(r.Context(), ids)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Deleted int `json:"deleted"`
+		}{n})
+	}
+}
+
+// completeAll marks every pending todo done, the counterpart of
+// clearCompleted.
+func completeAll(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := store.CompleteAll(r.Context())
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Completed int `json:"completed"`
+		}{n})
+	}
+}
+
+func toggleTodo(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		todo, err := store.ToggleCompleted(r.Context(), id)
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeTodo(w, r, http.StatusOK, todo)
+	}
+}
+
+func restoreTodo(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		err := store.RestoreDeleted(r.Context(), id)
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		todo, err := store.GetByID(r.Context(), id)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeTodo(w, r, http.StatusOK, todo)
+	}
+}
+
+// archiveTodo serves both POST /todos/{id}/archive and /unarchive, calling
+// set with the todo's id.
+func archiveTodo(store TodoStore, set func(TodoStore, context.Context, int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		err := set(store, r.Context(), id)
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		todo, err := store.GetByID(r.Context(), id)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeTodo(w, r, http.StatusOK, todo)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decodeResponse decodes body with decode and returns the response written.
+func decodeResponse(t *testing.T, body string, decode func(http.ResponseWriter, *http.Request) bool) (*httptest.ResponseRecorder, errorBody) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if decode(rec, httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(body))) {
+		t.Fatalf("decoding %s succeeded, want it refused", body)
+	}
+	var resp errorBody
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding the error response: %v", err)
+	}
+	return rec, resp
+}
+
+func TestDecodeErrorFields(t *testing.T) {
+	decoders := map[string]func(http.ResponseWriter, *http.Request) bool{
+		"decodeJSON": func(w http.ResponseWriter, r *http.Request) bool {
+			var input Todo
+			return decodeJSON(w, r, &input)
+		},
+		"decodeValidJSON": func(w http.ResponseWriter, r *http.Request) bool {
+			var input Todo
+			return decodeValidJSON(w, r, todoSchema, &input)
+		},
+	}
+	cases := []struct {
+		body  string
+		field string
+	}{
+		{`[1, 2]`, "body"},
+		{`"a todo"`, "body"},
+		{`{"title": 5}`, "title"},
+	}
+	for name, decode := range decoders {
+		for _, c := range cases {
+			rec, resp := decodeResponse(t, c.body, decode)
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Errorf("%s(%s): status = %d, want 422", name, c.body, rec.Code)
+			}
+			if len(resp.Error.Details) == 0 || resp.Error.Details[0].Field != c.field {
+				t.Errorf("%s(%s): details = %+v, want the first naming %q", name, c.body, resp.Error.Details, c.field)
+			}
+		}
+	}
+}
+
+func TestDecodeErrorMalformed(t *testing.T) {
+	var input Todo
+	rec, resp := decodeResponse(t, `{"title":`, func(w http.ResponseWriter, r *http.Request) bool {
+		return decodeJSON(w, r, &input)
+	})
+	if rec.Code != http.StatusBadRequest || resp.Error.Code != "bad_request" {
+		t.Errorf("status = %d, code %q; want 400 bad_request", rec.Code, resp.Error.Code)
+	}
+}
+
+func TestDecodeValidJSONReportsBlankTitle(t *testing.T) {
+	var input Todo
+	_, resp := decodeResponse(t, `{"title": " ", "priority": "x"}`, func(w http.ResponseWriter, r *http.Request) bool {
+		return decodeValidJSON(w, r, todoSchema, &input)
+	})
+	fields := map[string]bool{}
+	for _, d := range resp.Error.Details {
+		fields[d.Field] = true
+	}
+	if !fields["title"] || !fields["priority"] {
+		t.Errorf("details = %+v, want both title and priority reported", resp.Error.Details)
+	}
+}
+
+func TestWriteInternalErrorHidesError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeInternalError(rec, errors.New(`open /var/lib/todos.db: permission denied`))
+	var resp errorBody
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding the error response: %v", err)
+	}
+	if rec.Code != http.StatusInternalServerError || resp.Error.Message != internalErrorMessage {
+		t.Errorf("status = %d, message %q; want 500 with %q", rec.Code, resp.Error.Message, internalErrorMessage)
+	}
+}
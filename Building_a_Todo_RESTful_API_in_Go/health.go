@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// healthCheckTimeout bounds how long a probe waits for the database.
+const healthCheckTimeout = 2 * time.Second
+
+type healthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthz reports whether the server is up and the database answers a ping.
+// While requests are waiting for a lost database connection to come back, a
+// failed ping is reported as reconnecting rather than unavailable.
+func healthz(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+		if err := db.PingContext(ctx); err != nil {
+			status := "unavailable"
+			if db.Reconnecting() {
+				status = "reconnecting"
+			}
+			writeJSON(w, http.StatusServiceUnavailable, healthStatus{Status: status, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+	}
+}
+
+// readyz reports whether the server can take traffic: the database must
+// answer a ping and the schema migration must have run.
+func readyz(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !db.Migrated() {
+			writeJSON(w, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Error: "migrations have not run"})
+			return
+		}
+		healthz(db)(w, r)
+	}
+}
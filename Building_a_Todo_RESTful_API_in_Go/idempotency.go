@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultIdempotencyTTL is how long an Idempotency-Key is remembered
+	// when the store doesn't say otherwise.
+	defaultIdempotencyTTL = 24 * time.Hour
+	maxIdempotencyKeyLen  = 255
+)
+
+// ErrIdempotencyConflict is returned when another request with the same
+// Idempotency-Key committed first while this one was still running.
+var ErrIdempotencyConflict = errors.New("a request with this idempotency key is already in progress")
+
+func validateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLen {
+		return &ValidationError{Field: "Idempotency-Key", Message: fmt.Sprintf("must be at most %d characters", maxIdempotencyKeyLen)}
+	}
+	return nil
+}
+
+func idempotencyTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return defaultIdempotencyTTL
+	}
+	return ttl
+}
+
+// CreateIdempotent creates todo like Create, remembering key for the user in
+// ctx. Repeating a key within IdempotencyTTL returns the todo the first call
+// created, with replayed set, instead of inserting another one. If that todo
+// has since been deleted the result is ErrTodoNotFound.
+func (store *TodoSQLStore) CreateIdempotent(ctx context.Context, key string, todo *Todo) (created *Todo, replayed bool, err error) {
+	if err := validateIdempotencyKey(key); err != nil {
+		return nil, false, err
+	}
+	owner, _ := UserIDFromContext(ctx)
+	cutoff := time.Now().UTC().Add(-idempotencyTTL(store.IdempotencyTTL))
+	err = store.WithTx(ctx, func(tx *TodoSQLStore) error {
+		// Expired keys are cleared here rather than by a background job;
+		// creates with a key are the only thing that reads them.
+		if _, err := tx.conn().ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < ?", cutoff); err != nil {
+			return err
+		}
+		var id int
+		err := tx.conn().QueryRowContext(ctx, "SELECT todo_id FROM idempotency_keys WHERE owner = ? AND idempotency_key = ?", owner, key).Scan(&id)
+		if err == nil {
+			replayed = true
+			created, err = tx.GetByID(ctx, id)
+			return err
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if created, err = tx.Create(ctx, todo); err != nil {
+			return err
+		}
+		res, err := tx.conn().ExecContext(ctx, "INSERT INTO idempotency_keys (owner, idempotency_key, todo_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", owner, key, created.ID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrIdempotencyConflict
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return created, replayed, nil
+}
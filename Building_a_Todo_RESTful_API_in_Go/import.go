@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportOptions changes how Import runs.
+type ImportOptions struct {
+	// DryRun validates every row as a real import would, then throws the
+	// todos away again and reports each row in ImportResult.Rows.
+	DryRun bool
+}
+
+// ImportResult reports what an import did, or in a dry run what it would
+// have done. Rows are numbered from 1 in the order they appeared in the
+// upload, not counting a CSV header.
+type ImportResult struct {
+	DryRun   bool         `json:"dry_run,omitempty"`
+	Imported int          `json:"imported"`
+	Skipped  []ImportSkip `json:"skipped"`
+	// Rows lists every row, valid or not, in dry runs only.
+	Rows []ImportRow `json:"rows,omitempty"`
+}
+
+// ImportSkip is a row that was left out because it failed validation.
+type ImportSkip struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// ImportRow is how one row fared in a dry run.
+type ImportRow struct {
+	Row   int    `json:"row"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newImportResult(opts ImportOptions) *ImportResult {
+	result := &ImportResult{DryRun: opts.DryRun, Skipped: []ImportSkip{}}
+	if opts.DryRun {
+		result.Rows = []ImportRow{}
+	}
+	return result
+}
+
+// addRow records row as imported, or as skipped if err, a validation error,
+// is set.
+func (r *ImportResult) addRow(row int, err error) {
+	if err != nil {
+		r.Skipped = append(r.Skipped, ImportSkip{Row: row, Error: err.Error()})
+	} else {
+		r.Imported++
+	}
+	if r.DryRun {
+		entry := ImportRow{Row: row, OK: err == nil}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		r.Rows = append(r.Rows, entry)
+	}
+}
+
+// errDryRun rolls back the transaction of a dry-run import.
+var errDryRun = errors.New("dry run")
+
+// Import creates todos read one at a time from next, which returns io.EOF
+// once the input is exhausted. Rows failing validation, either in next or in
+// Create, are skipped and reported; any other error aborts the import. All
+// rows are inserted in one transaction, so an aborted import leaves nothing
+// behind, and a dry run rolls it back once every row has been tried.
+func (store *TodoSQLStore) Import(ctx context.Context, next func() (*Todo, error), opts ImportOptions) (*ImportResult, error) {
+	result := newImportResult(opts)
+	err := store.WithTx(ctx, func(tx *TodoSQLStore) error {
+		for row := 1; ; row++ {
+			todo, err := next()
+			if err == io.EOF {
+				if opts.DryRun {
+					return errDryRun
+				}
+				return nil
+			}
+			if err == nil {
+				_, err = tx.Create(ctx, todo)
+			}
+			if err != nil && !IsValidationError(err) {
+				return err
+			}
+			result.addRow(row, err)
+		}
+	})
+	if err != nil && err != errDryRun {
+		return nil, err
+	}
+	return result, nil
+}
+
+// malformedInputError means an upload couldn't be parsed at all, as opposed
+// to one row of it being invalid.
+type malformedInputError struct {
+	err error
+}
+
+func (e *malformedInputError) Error() string {
+	return "malformed import: " + e.err.Error()
+}
+
+func (e *malformedInputError) Unwrap() error {
+	return e.err
+}
+
+// jsonImportRows reads todos one by one from a JSON array.
+func jsonImportRows(r io.Reader) (func() (*Todo, error), error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, &malformedInputError{errors.New("body must be a JSON array")}
+	}
+	return func() (*Todo, error) {
+		if !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return nil, &malformedInputError{err}
+			}
+			return nil, io.EOF
+		}
+		// Decode the element on its own so a wrong type or unknown field
+		// only skips this row.
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, &malformedInputError{err}
+		}
+		var todo *Todo
+		item := json.NewDecoder(bytes.NewReader(raw))
+		item.DisallowUnknownFields()
+		if err := item.Decode(&todo); err != nil {
+			return nil, &ValidationError{Field: "row", Message: err.Error()}
+		}
+		if todo == nil {
+			return nil, &ValidationError{Field: "row", Message: "must be an object"}
+		}
+		return todo, nil
+	}, nil
+}
+
+// csvImportColumns are the columns a CSV import understands. The ones the
+// server assigns itself are accepted and ignored, so an export can be
+// imported again as is.
+var csvImportColumns = []string{"id", "title", "completed", "created_at", "updated_at", "due_date", "priority", "recurrence"}
+
+// csvImportRows reads todos one by one from CSV with a header row naming the
+// columns.
+func csvImportRows(r io.Reader) (func() (*Todo, error), error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, &malformedInputError{fmt.Errorf("reading CSV header: %w", err)}
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !contains(csvImportColumns, name) {
+			return nil, &malformedInputError{fmt.Errorf("unknown CSV column %q", name)}
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["title"]; !ok {
+		return nil, &malformedInputError{errors.New("CSV header has no title column")}
+	}
+	return func() (*Todo, error) {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, &malformedInputError{err}
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		todo := &Todo{
+			Title:      record[columns["title"]],
+			Priority:   field("priority"),
+			Recurrence: field("recurrence"),
+		}
+		if v := field("completed"); v != "" {
+			if todo.Completed, err = strconv.ParseBool(v); err != nil {
+				return nil, &ValidationError{Field: "completed", Message: "must be true or false"}
+			}
+		}
+		if v := field("due_date"); v != "" {
+			due, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, &ValidationError{Field: "due_date", Message: "must be an RFC3339 timestamp"}
+			}
+			todo.DueDate = &due
+		}
+		return todo, nil
+	}, nil
+}
+
+// importTodos handles POST /todos/import, reading a JSON array or, with a
+// text/csv Content-Type, a CSV file. The body is parsed as it is read rather
+// than loaded up front. With ?dry_run=true nothing is kept and the response
+// lists every row.
+func importTodos(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var opts ImportOptions
+		if v := r.URL.Query().Get("dry_run"); v != "" {
+			var err error
+			if opts.DryRun, err = strconv.ParseBool(v); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("invalid dry_run value %q: must be true or false", v))
+				return
+			}
+		}
+		mediaType := "application/json"
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			var err error
+			if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+				return
+			}
+		}
+		var next func() (*Todo, error)
+		var err error
+		switch mediaType {
+		case "application/json":
+			next, err = jsonImportRows(r.Body)
+		case "text/csv":
+			next, err = csvImportRows(r.Body)
+		default:
+			writeJSONError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "import must be application/json or text/csv")
+			return
+		}
+		if err == nil {
+			var result *ImportResult
+			if result, err = store.Import(r.Context(), next, opts); err == nil {
+				writeJSON(w, http.StatusOK, result)
+				return
+			}
+		}
+		var malformed *malformedInputError
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			writeTooLarge(w, tooLarge)
+		case errors.As(err, &malformed):
+			writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+		case errors.Is(err, ErrQuotaExceeded):
+			writeJSONError(w, http.StatusConflict, "quota_exceeded", err.Error())
+		default:
+			writeInternalError(w, err)
+		}
+	}
+}
@@ -1,64 +1,881 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"google.golang.org/grpc"
 )
 
 type Todo struct {
-	ID        int       `json:"id"`
-	Title     string    `json:"title"`
-	Completed bool      `json:"completed"`
-	CreatedAt time.Time `json:"created_at"`
+	// ID is left out of a todo with keysOnly set, and is never 0 otherwise.
+	ID        int        `json:"id,omitempty" xml:"id,omitempty"`
+	Title     string     `json:"title" xml:"title"`
+	Completed bool       `json:"completed" xml:"completed"`
+	CreatedAt time.Time  `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" xml:"updated_at"`
+	DueDate   *time.Time `json:"due_date,omitempty" xml:"due_date,omitempty"`
+	Priority  string     `json:"priority" xml:"priority"`
+	// Recurrence is "none", "daily", "weekly" or "monthly". Completing a
+	// recurring todo creates its next occurrence.
+	Recurrence string     `json:"recurrence" xml:"recurrence"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+	// Archived hides a todo from lists without completing it. It is only
+	// changed through Archive and Unarchive.
+	Archived bool `json:"archived" xml:"archived"`
+	// Position orders a user's todos for manual sorting, starting at 1. New
+	// todos go last; Reorder moves them.
+	Position int `json:"position" xml:"position"`
+	// ParentID makes this todo a subtask of another. It can only be set on
+	// create. A todo with keysOnly set shows parentKey in its place.
+	ParentID *int `json:"parent_id,omitempty" xml:"parent_id,omitempty"`
+	// ExternalID is a UUID or ULID the client may pick on create, so it
+	// knows the todo before the response arrives; under the uuid and ulid
+	// ID strategies one is generated otherwise. Creating a todo with an
+	// ExternalID the user already has returns that todo instead, which
+	// makes retries safe. It can only be set on create.
+	ExternalID *string `json:"external_id,omitempty" xml:"external_id,omitempty"`
+	// Children is only filled in for GET /todos/{id}?include=children.
+	Children []*Todo `json:"children,omitempty" xml:"-"`
+	// Tags is only filled in when a caller asks for it, e.g. GET
+	// /todos/{id}?include=tags.
+	Tags []string `json:"tags,omitempty" xml:"-"`
+	// Version is bumped on every change. Sending it back on PUT makes the
+	// update fail with ErrVersionConflict if someone else changed the todo
+	// in the meantime.
+	Version int `json:"version" xml:"version"`
+	// CreatedBy and UpdatedBy are the users who created the todo and last
+	// changed it. They are null for changes made without authentication,
+	// and background jobs such as the recurrence spawner don't set them.
+	CreatedBy *string `json:"created_by" xml:"created_by,omitempty"`
+	UpdatedBy *string `json:"updated_by" xml:"updated_by,omitempty"`
+	// keysOnly is set on the todos a keysOnlyStore returns: they are shown
+	// by their external ID alone, without the integer id.
+	keysOnly bool
+	// parentKey is the parent's external ID, set along with keysOnly. It is
+	// nil if the parent can't be looked up, and parent_id is then left out.
+	parentKey *string
+}
+
+// TodoStats summarises a user's todos for dashboards. Soft-deleted and
+// archived todos are not counted.
+type TodoStats struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Pending   int `json:"pending"`
+	// Overdue counts pending todos whose due date has passed.
+	Overdue int `json:"overdue"`
+	// CreatedToday counts todos created since midnight UTC.
+	CreatedToday int `json:"created_today"`
+}
+
+const (
+	defaultPriority = "medium"
+	maxTitleLength  = 500
+)
+
+var priorities = []string{"low", "medium", "high"}
+
+// ValidationError reports a todo field that failed validation.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors lists every field of one input that failed validation,
+// so a client can fix them all at once instead of one per request.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap lets errors.As find each *ValidationError in the list.
+func (errs ValidationErrors) Unwrap() []error {
+	wrapped := make([]error, len(errs))
+	for i, e := range errs {
+		wrapped[i] = e
+	}
+	return wrapped
+}
+
+// add appends the problems in err, if any, to errs.
+func (errs *ValidationErrors) add(err error) {
+	*errs = append(*errs, validationErrors(err)...)
+}
+
+// err returns errs as an error, or nil if there are none.
+func (errs ValidationErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// prefixed returns errs with prefix put in front of every field name.
+func (errs ValidationErrors) prefixed(prefix string) ValidationErrors {
+	out := make(ValidationErrors, len(errs))
+	for i, e := range errs {
+		out[i] = &ValidationError{Field: prefix + e.Field, Message: e.Message}
+	}
+	return out
+}
+
+// validationErrors returns the field problems err is made of: the list a
+// ValidationErrors holds, or a single *ValidationError. It is nil for any
+// other error.
+func validationErrors(err error) ValidationErrors {
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		return errs
+	}
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return ValidationErrors{ve}
+	}
+	return nil
+}
+
+// IsValidationError reports whether err was caused by invalid todo input.
+func IsValidationError(err error) bool {
+	var ve *ValidationError
+	return errors.As(err, &ve)
+}
+
+// validate fills in defaults and checks the todo's fields before it is
+// written to the store. Every invalid field is reported, as
+// ValidationErrors, not just the first.
+func (t *Todo) validate() error {
+	var errs ValidationErrors
+	if title, err := validateTitle(t.Title); err != nil {
+		errs.add(err)
+	} else {
+		t.Title = title
+	}
+	if t.Priority == "" {
+		t.Priority = defaultPriority
+	}
+	if !contains(priorities, t.Priority) {
+		errs.add(&ValidationError{Field: "priority", Message: "must be one of " + strings.Join(priorities, ", ")})
+	}
+	if t.DueDate != nil {
+		// Stored in UTC, SQLite's text timestamps compare in time order.
+		due := t.DueDate.UTC()
+		t.DueDate = &due
+	}
+	if t.Recurrence == "" {
+		t.Recurrence = recurrenceNone
+	}
+	errs.add(validateRecurrence(t.Recurrence))
+	if t.ExternalID != nil {
+		if id, err := validateExternalID(*t.ExternalID); err != nil {
+			errs.add(err)
+		} else {
+			t.ExternalID = &id
+		}
+	}
+	return errs.err()
+}
+
+// normalizeTitle trims surrounding whitespace from title and collapses every
+// run of whitespace inside it, newlines and tabs included, to one space.
+func normalizeTitle(title string) string {
+	return strings.Join(strings.Fields(title), " ")
+}
+
+// validateTitle normalizes title and checks that what is left is between 1
+// and maxTitleLength characters long.
+func validateTitle(title string) (string, error) {
+	title = normalizeTitle(title)
+	if title == "" {
+		return "", &ValidationError{Field: "title", Message: "must not be empty"}
+	}
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return "", &ValidationError{Field: "title", Message: fmt.Sprintf("must be at most %d characters", maxTitleLength)}
+	}
+	return title, nil
+}
+
+// ErrTodoNotFound is returned by TodoStore methods when no todo matches the
+// given ID. It wraps sql.ErrNoRows so existing checks keep working.
+var ErrTodoNotFound = fmt.Errorf("todo not found: %w", sql.ErrNoRows)
+
+// ErrVersionConflict is returned by Update when the todo's version no longer
+// matches the one the caller read.
+var ErrVersionConflict = errors.New("todo was modified by another request")
+
+// IsNotFound reports whether err means the requested todo does not exist.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrTodoNotFound)
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// PageSizes bounds how many todos one list or search returns. Zero fields
+// mean defaultPageSize and maxPageSize.
+type PageSizes struct {
+	// Default is the page size when the request doesn't give one.
+	Default int
+	// Max is the largest page size; bigger requests are capped to it.
+	Max int
+}
+
+func (p PageSizes) withDefaults() PageSizes {
+	if p.Default == 0 {
+		p.Default = defaultPageSize
+	}
+	if p.Max == 0 {
+		p.Max = maxPageSize
+	}
+	return p
+}
+
+// clamp keeps limit between 1 and Max.
+func (p PageSizes) clamp(limit int) int {
+	return min(max(limit, 1), p.withDefaults().Max)
+}
+
+// TodoFilter narrows the set of todos returned by GetAll and Count. A nil
+// field means "don't filter on this".
+type TodoFilter struct {
+	Completed *bool
+	Priority  string
+	// Priorities limits the result to todos with any of these priorities.
+	Priorities []string
+	// Query matches todos whose title contains it, case-insensitively.
+	Query string
+	// Tag limits the result to todos carrying this tag.
+	Tag string
+	// Recurring limits the result to todos that do or don't repeat.
+	Recurring *bool
+	// Archived returns the archived todos instead of the unarchived ones.
+	Archived bool
+	// CreatedAfter and CreatedBefore limit the result to todos created at or
+	// after, and strictly before, the given times.
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// DueAfter and DueBefore limit the result to todos due at or after, and
+	// strictly before, the given times. Todos without a due date never match.
+	DueAfter  *time.Time
+	DueBefore *time.Time
+	// Overdue limits the result to todos that are, or aren't, overdue at
+	// OverdueAt: not completed and due strictly before it. A zero OverdueAt
+	// means when the query runs.
+	Overdue   *bool
+	OverdueAt time.Time
+	// UserID limits the result to one user's todos. The store sets it from
+	// the request context, so callers don't need to.
+	UserID string
+	// IncludeDeleted also returns soft-deleted todos.
+	IncludeDeleted bool
+}
+
+// where builds the WHERE clause and its arguments for the filter.
+func (f TodoFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if !f.IncludeDeleted {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if f.UserID != "" {
+		conds = append(conds, "user_id = ?")
+		args = append(args, f.UserID)
+	}
+	conds = append(conds, "archived = ?")
+	args = append(args, f.Archived)
+	if f.Completed != nil {
+		conds = append(conds, "completed = ?")
+		args = append(args, *f.Completed)
+	}
+	if f.Priority != "" {
+		conds = append(conds, "priority = ?")
+		args = append(args, f.Priority)
+	}
+	if len(f.Priorities) > 0 {
+		conds = append(conds, "priority IN (?"+strings.Repeat(", ?", len(f.Priorities)-1)+")")
+		for _, p := range f.Priorities {
+			args = append(args, p)
+		}
+	}
+	if f.Recurring != nil {
+		if *f.Recurring {
+			conds = append(conds, "recurrence <> ?")
+		} else {
+			conds = append(conds, "recurrence = ?")
+		}
+		args = append(args, recurrenceNone)
+	}
+	if f.CreatedAfter != nil {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, f.CreatedAfter.UTC())
+	}
+	if f.CreatedBefore != nil {
+		conds = append(conds, "created_at < ?")
+		args = append(args, f.CreatedBefore.UTC())
+	}
+	if f.DueAfter != nil {
+		conds = append(conds, "due_date >= ?")
+		args = append(args, f.DueAfter.UTC())
+	}
+	if f.DueBefore != nil {
+		conds = append(conds, "due_date < ?")
+		args = append(args, f.DueBefore.UTC())
+	}
+	if f.Overdue != nil {
+		if *f.Overdue {
+			conds = append(conds, "NOT completed AND due_date < ?")
+		} else {
+			conds = append(conds, "(completed OR due_date IS NULL OR due_date >= ?)")
+		}
+		args = append(args, f.overdueAt())
+	}
+	if f.Tag != "" {
+		conds = append(conds, "id IN (SELECT tt.todo_id FROM todo_tags tt JOIN tags t ON t.id = tt.tag_id WHERE t.name = ?)")
+		args = append(args, f.Tag)
+	}
+	if f.Query != "" {
+		conds = append(conds, `LOWER(title) LIKE LOWER(?) ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(f.Query)+"%")
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// overdueAt is the time Overdue is judged at, in UTC.
+func (f TodoFilter) overdueAt() time.Time {
+	if f.OverdueAt.IsZero() {
+		return time.Now().UTC()
+	}
+	return f.OverdueAt.UTC()
+}
+
+// likeEscaper escapes the LIKE wildcards so user input only matches literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// sortColumns lists the columns the list endpoint may be sorted by. The ORDER
+// BY clause is built from these names, so anything else must be rejected.
+var sortColumns = []string{"id", "title", "completed", "created_at", "updated_at", "due_date", "position"}
+
+// ListOptions controls which page of todos GetAll returns and in what order.
+type ListOptions struct {
+	TodoFilter
+	Limit  int
+	Offset int
+	Sort   string
+	Order  string
+	// After, if set, returns only todos with a greater id. Paging by the
+	// last id seen instead of an offset doesn't skip or repeat rows when
+	// todos are created concurrently; it needs Sort "id" and Order "asc".
+	After int
+	// Fields, if set, are the todoFields a store may limit itself to
+	// reading; the other fields of the todos returned may be left zero. The
+	// id is always read.
+	Fields []string
+}
+
+// where extends the filter's WHERE clause with the After cursor.
+func (opts ListOptions) where() (string, []interface{}) {
+	where, args := opts.TodoFilter.where()
+	if opts.After == 0 {
+		return where, args
+	}
+	return where + " AND id > ?", append(args, opts.After)
+}
+
+// orderBy builds the ORDER BY clause. Sort and Order must already have been
+// validated against sortColumns and asc/desc. The id tiebreaker keeps paging
+// stable when several rows share the same sort value. Todos without a due
+// date sort as if due after every other, which SQLite and Postgres would
+// otherwise disagree on.
+func (opts ListOptions) orderBy() string {
+	switch opts.Sort {
+	case "id":
+		return " ORDER BY id " + opts.Order
+	case "due_date":
+		return " ORDER BY due_date IS NULL " + opts.Order + ", due_date " + opts.Order + ", id " + opts.Order
+	}
+	return " ORDER BY " + opts.Sort + " " + opts.Order + ", id " + opts.Order
 }
 
 type TodoStore interface {
-	GetAll() ([]*Todo, error)
-	GetByID(int) (*Todo, error)
-	Create(string) (*Todo, error)
-	Update(*Todo) error
-	Delete(int) error
+	GetAll(context.Context, ListOptions) ([]*Todo, error)
+	GetAllUnscoped(context.Context, ListOptions) ([]*OwnedTodo, int, error)
+	Count(context.Context, TodoFilter) (int, error)
+	ForEach(context.Context, TodoFilter, func(*Todo) error) error
+	GetByID(context.Context, int) (*Todo, error)
+	GetByIDs(context.Context, []int) ([]*Todo, error)
+	ResolveKey(context.Context, string) (int, error)
+	Create(context.Context, *Todo) (*Todo, error)
+	CreateIdempotent(context.Context, string, *Todo) (*Todo, bool, error)
+	CreateBulk(context.Context, []*Todo) ([]*Todo, error)
+	Import(context.Context, func() (*Todo, error), ImportOptions) (*ImportResult, error)
+	Update(context.Context, *Todo) error
+	UpdateFields(context.Context, int, map[string]interface{}) error
+	ToggleCompleted(context.Context, int) (*Todo, error)
+	Delete(context.Context, int) error
+	HardDelete(context.Context, int) error
+	RestoreDeleted(context.Context, int) error
+	Undo(context.Context) (*Todo, error)
+	Archive(context.Context, int) error
+	Unarchive(context.Context, int) error
+	Reorder(context.Context, int, int) error
+	DeleteCompleted(context.Context) (int, error)
+	DeleteMany(context.Context, []int) (int, error)
+	CompleteAll(context.Context) (int, error)
+	Stats(context.Context) (*TodoStats, error)
+	AddTag(context.Context, int, string) error
+	RemoveTag(context.Context, int, string) error
+	GetTags(context.Context, int) ([]string, error)
+	GetChildren(context.Context, int) ([]*Todo, error)
+	History(context.Context, int) ([]*AuditEntry, error)
 }
 
+// Supported database/sql driver names.
+const (
+	driverSQLite   = "sqlite3"
+	driverPostgres = "postgres"
+)
+
 type DB struct {
 	*sql.DB
+	// Driver is the database/sql driver the connection was opened with.
+	Driver string
+
+	migrated     atomic.Bool
+	reconnecting atomic.Int32
+}
+
+// DBOptions tunes the database/sql connection pool and SQLite. Zero values
+// keep the defaults.
+type DBOptions struct {
+	// MaxOpenConns caps open connections. It defaults to 1 for SQLite and
+	// to no limit for Postgres.
+	MaxOpenConns int
+	// MaxIdleConns caps idle connections kept for reuse; database/sql
+	// defaults to 2.
+	MaxIdleConns int
+	// ConnMaxLifetime closes connections once they are this old; by default
+	// they are reused forever.
+	ConnMaxLifetime time.Duration
+	// BusyTimeout is how long a SQLite connection waits for a lock held by
+	// another one before failing; it defaults to 5s.
+	BusyTimeout time.Duration
+}
+
+const defaultBusyTimeout = 5 * time.Second
+
+// sqliteDSN adds connection parameters to a SQLite dataSourceName: WAL
+// journaling so readers don't block the writer, a busy timeout so a locked
+// database is waited for instead of failing, and foreign key enforcement.
+// go-sqlite3 applies these to every connection it opens, which a PRAGMA run
+// once after opening would not. Parameters already in the name take
+// precedence.
+func sqliteDSN(dataSourceName string, busyTimeout time.Duration) string {
+	if busyTimeout == 0 {
+		busyTimeout = defaultBusyTimeout
+	}
+	sep := "?"
+	if strings.Contains(dataSourceName, "?") {
+		sep = "&"
+	}
+	return dataSourceName + sep + "_journal_mode=WAL&_busy_timeout=" + strconv.FormatInt(busyTimeout.Milliseconds(), 10) + "&_foreign_keys=on"
 }
 
-func NewDB(dataSourceName string) (*DB, error) {
-	db, err := sql.Open("sqlite3", dataSourceName)
+// isPostgresURL reports whether dataSourceName is a postgres:// or
+// postgresql:// URL rather than a SQLite file path.
+func isPostgresURL(dataSourceName string) bool {
+	return strings.HasPrefix(dataSourceName, "postgres://") || strings.HasPrefix(dataSourceName, "postgresql://")
+}
+
+// NewDB opens a database connection. A dataSourceName starting with
+// postgres:// or postgresql:// is opened with lib/pq; anything else is
+// treated as a SQLite file path.
+func NewDB(dataSourceName string, opts DBOptions) (*DB, error) {
+	driver := driverSQLite
+	if isPostgresURL(dataSourceName) {
+		driver = driverPostgres
+	}
+	if driver == driverSQLite {
+		dataSourceName = sqliteDSN(dataSourceName, opts.BusyTimeout)
+	}
+
+	db, err := sql.Open(driver, dataSourceName)
 	if err != nil {
 		return nil, err
 	}
+	if opts.MaxOpenConns == 0 && driver == driverSQLite {
+		// SQLite allows a single writer at a time. With several pooled
+		// connections, concurrent writes fail with "database is locked"
+		// instead of waiting, so by default everything queues on one.
+		opts.MaxOpenConns = 1
+	}
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+	return &DB{DB: db, Driver: driver}, nil
 }
 
-func (db *DB) EnsureMigration() error {
-	_, err := db.Exec(`
-  CREATE TABLE IF NOT EXISTS todos (
-   id INTEGER PRIMARY KEY AUTOINCREMENT,
-   title TEXT NOT NULL,
-   completed BOOLEAN NOT NULL DEFAULT false,
-   created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-  );
- `)
-	return err
+// rebind rewrites the ? placeholders used throughout the store into the
+// driver's native style. Postgres wants $1, $2, ...; SQLite takes ? as is.
+func (db *DB) rebind(query string) string {
+	if db.Driver != driverPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// idColumn is the definition of an auto-incrementing integer primary key.
+func (db *DB) idColumn() string {
+	if db.Driver == driverPostgres {
+		return "SERIAL PRIMARY KEY"
+	}
+	return "INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+// timestampType is the column type used for timestamps on this driver.
+func (db *DB) timestampType() string {
+	if db.Driver == driverPostgres {
+		return "TIMESTAMPTZ"
+	}
+	return "DATETIME"
+}
+
+// Migrated reports whether EnsureMigration has completed on this connection.
+func (db *DB) Migrated() bool {
+	return db.migrated.Load()
 }
 
 type TodoSQLStore struct {
 	DB *DB
+	// tx is set on stores handed out by WithTx; queries then run inside it.
+	tx *sql.Tx
+	// stmts holds the statements NewTodoSQLStore prepared, keyed by their
+	// query text before rebinding. Other queries are run ad hoc.
+	stmts map[string]*sql.Stmt
+	// IdempotencyTTL is how long CreateIdempotent remembers a key; zero
+	// means defaultIdempotencyTTL.
+	IdempotencyTTL time.Duration
+	// UndoDepth is how many deletes per user Undo can take back; zero means
+	// defaultUndoDepth.
+	UndoDepth int
+	// IDStrategy is one of idStrategies; under idUUID and idULID, Create
+	// generates an external ID for todos created without one.
+	IDStrategy string
+	// Quota limits how many todos Create lets each user have.
+	Quota TodoQuota
+	undo  *undoStack
+}
+
+// getByIDQuery is the query GetByID runs for a todoMatch condition.
+func getByIDQuery(match string) string {
+	return "SELECT " + todoColumns + " FROM todos WHERE " + match + " AND deleted_at IS NULL"
+}
+
+const insertTodoQuery = "INSERT INTO todos (title, completed, due_date, priority, recurrence, parent_id, user_id, created_by, updated_by, external_id, position, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, " + nextPositionQuery + ", CURRENT_TIMESTAMP) ON CONFLICT (external_id) DO NOTHING RETURNING id"
+
+// preparedQueries are the hot queries worth preparing once up front: the
+// lookup every read and write goes through, with and without a user, and the
+// insert.
+var preparedQueries = []string{
+	getByIDQuery("id = ?"),
+	getByIDQuery("id = ? AND user_id = ?"),
+	insertTodoQuery,
+}
+
+// NewTodoSQLStore returns a store using db with preparedQueries prepared.
+// Close releases the statements.
+func NewTodoSQLStore(db *DB) (*TodoSQLStore, error) {
+	store := &TodoSQLStore{DB: db, stmts: make(map[string]*sql.Stmt, len(preparedQueries)), undo: newUndoStack()}
+	for _, query := range preparedQueries {
+		stmt, err := db.Prepare(db.rebind(query))
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("preparing %q: %w", query, err)
+		}
+		store.stmts[query] = stmt
+	}
+	return store, nil
+}
+
+// Close closes the prepared statements. It doesn't close the DB.
+func (store *TodoSQLStore) Close() error {
+	var first error
+	for _, stmt := range store.stmts {
+		if err := stmt.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// dbtx is the subset of *sql.DB and *sql.Tx the store runs queries through.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// boundConn runs a query through its prepared statement if there is one, and
+// otherwise rebinds placeholders for the driver and runs it ad hoc. Outside a
+// transaction, statements that fail because the database is busy or
+// unreachable are retried with withRetry; inside one a statement can't be
+// retried on its own, so the error is returned and the transaction rolled
+// back.
+type boundConn struct {
+	dbtx
+	db    *DB
+	tx    *sql.Tx
+	stmts map[string]*sql.Stmt
+}
+
+// prepared returns the statement prepared for query, bound to the
+// transaction if there is one, or nil.
+func (c boundConn) prepared(ctx context.Context, query string) *sql.Stmt {
+	stmt, ok := c.stmts[query]
+	if !ok {
+		return nil
+	}
+	if c.tx != nil {
+		return c.tx.StmtContext(ctx, stmt)
+	}
+	return stmt
+}
+
+// retry runs op once in a transaction and through withRetry otherwise.
+func (c boundConn) retry(ctx context.Context, op func() error) error {
+	if c.tx != nil {
+		return op()
+	}
+	return c.db.withRetry(ctx, op)
+}
+
+func (c boundConn) ExecContext(ctx context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	err = c.retry(ctx, func() error {
+		if stmt := c.prepared(ctx, query); stmt != nil {
+			res, err = stmt.ExecContext(ctx, args...)
+		} else {
+			res, err = c.dbtx.ExecContext(ctx, c.db.rebind(query), args...)
+		}
+		return err
+	})
+	return res, err
+}
+
+func (c boundConn) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	err = c.retry(ctx, func() error {
+		if stmt := c.prepared(ctx, query); stmt != nil {
+			rows, err = stmt.QueryContext(ctx, args...)
+		} else {
+			rows, err = c.dbtx.QueryContext(ctx, c.db.rebind(query), args...)
+		}
+		return err
+	})
+	return rows, err
+}
+
+// QueryRowContext isn't retried: SQLite only runs the statement when the
+// row is scanned, after it has been handed back. Writes that read a row back
+// go through scanRow instead.
+func (c boundConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if stmt := c.prepared(ctx, query); stmt != nil {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return c.dbtx.QueryRowContext(ctx, c.db.rebind(query), args...)
+}
+
+// scanRow runs query and scans its single row into dest, retrying both
+// together like ExecContext.
+func (c boundConn) scanRow(ctx context.Context, query string, args []interface{}, dest ...interface{}) error {
+	return c.retry(ctx, func() error {
+		return c.QueryRowContext(ctx, query, args...).Scan(dest...)
+	})
+}
+
+func (store *TodoSQLStore) conn() boundConn {
+	if store.tx != nil {
+		return boundConn{store.tx, store.DB, store.tx, store.stmts}
+	}
+	return boundConn{store.DB.DB, store.DB, nil, store.stmts}
+}
+
+// WithTx runs fn with a store bound to a new transaction. The transaction is
+// committed if fn returns nil and rolled back if it returns an error or
+// panics. Calling WithTx on a store that is already in a transaction reuses
+// that transaction.
+func (store *TodoSQLStore) WithTx(ctx context.Context, fn func(*TodoSQLStore) error) (err error) {
+	if store.tx != nil {
+		return fn(store)
+	}
+
+	tx, err := store.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	return fn(&TodoSQLStore{DB: store.DB, tx: tx, stmts: store.stmts, IdempotencyTTL: store.IdempotencyTTL, UndoDepth: store.UndoDepth, IDStrategy: store.IDStrategy, Quota: store.Quota, undo: store.undo})
+}
+
+// retryTx is WithTx for a transaction that can simply be run again: queries
+// inside a transaction aren't retried when SQLite is busy or the connection
+// is lost, so the whole transaction is instead, unless store is already in
+// one.
+func (store *TodoSQLStore) retryTx(ctx context.Context, fn func(*TodoSQLStore) error) error {
+	if store.tx != nil {
+		return fn(store)
+	}
+	return store.DB.withRetry(ctx, func() error { return store.WithTx(ctx, fn) })
+}
+
+// todoFields maps each column a Todo is read from, which is also the field's
+// JSON name, to the Todo field it is scanned into. It is the allowlist for
+// ?fields=; a column list is only ever built from its keys.
+var todoFields = map[string]func(*Todo) interface{}{
+	"id":          func(t *Todo) interface{} { return &t.ID },
+	"title":       func(t *Todo) interface{} { return &t.Title },
+	"completed":   func(t *Todo) interface{} { return &t.Completed },
+	"archived":    func(t *Todo) interface{} { return &t.Archived },
+	"position":    func(t *Todo) interface{} { return &t.Position },
+	"created_at":  func(t *Todo) interface{} { return &t.CreatedAt },
+	"updated_at":  func(t *Todo) interface{} { return &t.UpdatedAt },
+	"due_date":    func(t *Todo) interface{} { return &t.DueDate },
+	"priority":    func(t *Todo) interface{} { return &t.Priority },
+	"recurrence":  func(t *Todo) interface{} { return &t.Recurrence },
+	"parent_id":   func(t *Todo) interface{} { return &t.ParentID },
+	"deleted_at":  func(t *Todo) interface{} { return &t.DeletedAt },
+	"version":     func(t *Todo) interface{} { return &t.Version },
+	"created_by":  func(t *Todo) interface{} { return &t.CreatedBy },
+	"external_id": func(t *Todo) interface{} { return &t.ExternalID },
+	"updated_by":  func(t *Todo) interface{} { return &t.UpdatedBy },
+}
+
+// todoFieldNames lists the todoFields keys, for error messages.
+func todoFieldNames() string {
+	names := make([]string, 0, len(todoFields))
+	for name := range todoFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// fieldScanner returns the column list for fields, with id added if it is
+// missing, and a scan function reading those columns into a Todo.
+func fieldScanner(fields []string) (string, func(rowScanner) (*Todo, error)) {
+	if !contains(fields, "id") {
+		fields = append([]string{"id"}, fields...)
+	}
+	return strings.Join(fields, ", "), func(row rowScanner) (*Todo, error) {
+		var todo Todo
+		dest := make([]interface{}, len(fields))
+		for i, field := range fields {
+			dest[i] = todoFields[field](&todo)
+		}
+		if err := row.Scan(dest...); err != nil {
+			return nil, err
+		}
+		return &todo, nil
+	}
+}
+
+// todoColumns is the column list scanTodo expects, in order.
+const todoColumns = "id, title, completed, archived, position, created_at, updated_at, due_date, priority, recurrence, parent_id, deleted_at, version, created_by, updated_by, external_id"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTodo(row rowScanner) (*Todo, error) {
+	var todo Todo
+	if err := row.Scan(&todo.ID, &todo.Title, &todo.Completed, &todo.Archived, &todo.Position, &todo.CreatedAt, &todo.UpdatedAt, &todo.DueDate, &todo.Priority, &todo.Recurrence, &todo.ParentID, &todo.DeletedAt, &todo.Version, &todo.CreatedBy, &todo.UpdatedBy, &todo.ExternalID); err != nil {
+		return nil, err
+	}
+	return &todo, nil
+}
+
+// scopeFilter restricts filter to the todos of the user in ctx, if any.
+func scopeFilter(ctx context.Context, filter TodoFilter) TodoFilter {
+	if userID, ok := UserIDFromContext(ctx); ok {
+		filter.UserID = userID
+	}
+	return filter
+}
+
+// todoMatch builds the condition selecting todo id, limited to the todos of
+// the user in ctx. Another user's todo simply doesn't match, so it reads as
+// not found rather than forbidden.
+func todoMatch(ctx context.Context, id int) (string, []interface{}) {
+	if userID, ok := UserIDFromContext(ctx); ok {
+		return "id = ? AND user_id = ?", []interface{}{id, userID}
+	}
+	return "id = ?", []interface{}{id}
 }
 
-func (store *TodoSQLStore) GetAll() ([]*Todo, error) {
-	rows, err := store.DB.Query("SELECT id, title, completed, created_at FROM todos")
+func (store *TodoSQLStore) GetAll(ctx context.Context, opts ListOptions) ([]*Todo, error) {
+	opts.TodoFilter = scopeFilter(ctx, opts.TodoFilter)
+	where, args := opts.where()
+	args = append(args, opts.Limit, opts.Offset)
+	columns, scan := todoColumns, scanTodo
+	if len(opts.Fields) > 0 {
+		columns, scan = fieldScanner(opts.Fields)
+	}
+	rows, err := store.conn().QueryContext(ctx, "SELECT "+columns+" FROM todos"+where+opts.orderBy()+" LIMIT ? OFFSET ?", args...)
 	if err != nil {
 		return nil, err
 	}
@@ -66,145 +883,752 @@ func (store *TodoSQLStore) GetAll() ([]*Todo, error) {
 
 	var todos []*Todo
 	for rows.Next() {
-		var todo Todo
-		if err := rows.Scan(&todo.ID, &todo.Title, &todo.Completed, &todo.CreatedAt); err != nil {
+		todo, err := scan(rows)
+		if err != nil {
 			return nil, err
 		}
-		todos = append(todos, &todo)
+		todos = append(todos, todo)
 	}
 	return todos, nil
 }
 
-func (store *TodoSQLStore) GetByID(id int) (*Todo, error) {
-	row := store.DB.QueryRow("SELECT id, title, completed, created_at FROM todos WHERE id = ?", id)
+func (store *TodoSQLStore) Count(ctx context.Context, filter TodoFilter) (int, error) {
+	where, args := scopeFilter(ctx, filter).where()
+	var n int
+	if err := store.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM todos"+where, args...).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
 
-	var todo Todo
-	if err := row.Scan(&todo.ID, &todo.Title, &todo.Completed, &todo.CreatedAt); err != nil {
+// Stats computes every TodoStats count in a single aggregate query.
+func (store *TodoSQLStore) Stats(ctx context.Context) (*TodoStats, error) {
+	where, args := scopeFilter(ctx, TodoFilter{}).where()
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	args = append([]interface{}{now, today}, args...)
+	var stats TodoStats
+	err := store.conn().QueryRowContext(ctx, `SELECT
+		COUNT(*),
+		COUNT(CASE WHEN completed THEN 1 END),
+		COUNT(CASE WHEN NOT completed AND due_date < ? THEN 1 END),
+		COUNT(CASE WHEN created_at >= ? THEN 1 END)
+		FROM todos`+where, args...).Scan(&stats.Total, &stats.Completed, &stats.Overdue, &stats.CreatedToday)
+	if err != nil {
 		return nil, err
 	}
-	return &todo, nil
+	stats.Pending = stats.Total - stats.Completed
+	return &stats, nil
+}
+
+func (store *TodoSQLStore) GetByID(ctx context.Context, id int) (*Todo, error) {
+	match, args := todoMatch(ctx, id)
+	row := store.conn().QueryRowContext(ctx, getByIDQuery(match), args...)
+
+	todo, err := scanTodo(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTodoNotFound
+	}
+	return todo, err
 }
 
-func (store *TodoSQLStore) Create(title string) (*Todo, error) {
-	res, err := store.DB.Exec("INSERT INTO todos (title) VALUES (?)", title)
+// GetByIDs fetches the todos with the given IDs in one query, in the order
+// the IDs are given. IDs that don't exist, or that GetByID wouldn't return,
+// are left out rather than reported.
+func (store *TodoSQLStore) GetByIDs(ctx context.Context, ids []int) ([]*Todo, error) {
+	ids = uniqueIDs(ids)
+	if len(ids) == 0 {
+		return []*Todo{}, nil
+	}
+	where := "id IN (" + strings.Repeat("?, ", len(ids)-1) + "?)"
+	args := make([]interface{}, 0, len(ids)+1)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	if userID, ok := UserIDFromContext(ctx); ok {
+		where += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	rows, err := store.conn().QueryContext(ctx, getByIDQuery(where), args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	found := make(map[int]*Todo, len(ids))
+	for rows.Next() {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return nil, err
+		}
+		found[todo.ID] = todo
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	todos := make([]*Todo, 0, len(found))
+	for _, id := range ids {
+		if todo, ok := found[id]; ok {
+			todos = append(todos, todo)
+		}
+	}
+	return todos, nil
+}
 
-	id, err := res.LastInsertId()
+// uniqueIDs drops repeated IDs, keeping the first occurrence of each.
+func uniqueIDs(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	out := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func (store *TodoSQLStore) Create(ctx context.Context, todo *Todo) (*Todo, error) {
+	if todo.ExternalID == nil {
+		todo.ExternalID = newExternalID(store.IDStrategy)
+	}
+	if err := todo.validate(); err != nil {
+		return nil, err
+	}
+	if err := store.checkParent(ctx, todo.ParentID); err != nil {
+		return nil, err
+	}
+	// RETURNING works on both SQLite and Postgres, whereas lib/pq has no
+	// LastInsertId.
+	userID := actorID(ctx)
+	args := []interface{}{todo.Title, todo.Completed, todo.DueDate, todo.Priority, todo.Recurrence, todo.ParentID, userID, userID, userID, todo.ExternalID, userID}
+	var created *Todo
+	err := store.retryTx(ctx, func(tx *TodoSQLStore) error {
+		// A retry is answered before the quota is checked, since it adds
+		// nothing.
+		var err error
+		if created, err = tx.byExternalID(ctx, todo.ExternalID); created != nil || err != nil {
+			return err
+		}
+		if err := tx.checkQuota(ctx); err != nil {
+			return err
+		}
+		var id int
+		err = tx.conn().scanRow(ctx, insertTodoQuery, args, &id)
+		if errors.Is(err, sql.ErrNoRows) {
+			// ON CONFLICT skipped the insert: a concurrent retry got there
+			// first.
+			if created, err = tx.byExternalID(ctx, todo.ExternalID); created == nil && err == nil {
+				err = errExternalIDTaken
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if created, err = tx.GetByID(ctx, id); err != nil {
+			return err
+		}
+		return tx.recordAudit(ctx, id, userID, auditCreated, todoDiff(nil, created))
+	})
 	if err != nil {
 		return nil, err
 	}
+	return created, nil
+}
 
-	return store.GetByID(int(id))
+// validateBulk validates every one of todos before a bulk create starts and
+// reports the problems of all of them together, each field prefixed with the
+// todo's index, e.g. "[1].title".
+func validateBulk(todos []*Todo) error {
+	var errs ValidationErrors
+	for i, todo := range todos {
+		prefix := fmt.Sprintf("[%d]", i)
+		if todo == nil {
+			errs.add(&ValidationError{Field: prefix, Message: "must be an object"})
+			continue
+		}
+		errs = append(errs, validationErrors(todo.validate()).prefixed(prefix+".")...)
+	}
+	return errs.err()
 }
 
-func (store *TodoSQLStore) Update(todo *Todo) error {
-	_, err := store.DB.Exec("UPDATE todos SET title = ?, completed = ? WHERE id = ?", todo.Title, todo.Completed, todo.ID)
-	return err
+// CreateBulk inserts all todos in one transaction. If any of them fails
+// validation nothing is inserted and the error lists the problems of every
+// offending index.
+func (store *TodoSQLStore) CreateBulk(ctx context.Context, todos []*Todo) ([]*Todo, error) {
+	if err := validateBulk(todos); err != nil {
+		return nil, err
+	}
+	created := make([]*Todo, 0, len(todos))
+	err := store.WithTx(ctx, func(tx *TodoSQLStore) error {
+		for i, todo := range todos {
+			c, err := tx.Create(ctx, todo)
+			if errs := validationErrors(err); errs != nil {
+				return errs.prefixed(fmt.Sprintf("[%d].", i))
+			}
+			if err != nil {
+				return err
+			}
+			created = append(created, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
 }
 
-func (store *TodoSQLStore) Delete(id int) error {
-	_, err := store.DB.Exec("DELETE FROM todos WHERE id = ?", id)
+// Update overwrites a todo. If todo.Version is set, the update only applies
+// when it still matches the stored version; otherwise ErrVersionConflict is
+// returned. A zero Version skips the check.
+func (store *TodoSQLStore) Update(ctx context.Context, todo *Todo) error {
+	if err := todo.validate(); err != nil {
+		return err
+	}
+	return store.audited(ctx, todo.ID, auditUpdated, func(tx *TodoSQLStore) error {
+		return tx.update(ctx, todo)
+	})
+}
+
+func (store *TodoSQLStore) update(ctx context.Context, todo *Todo) error {
+	match, matchArgs := todoMatch(ctx, todo.ID)
+	query := "UPDATE todos SET title = ?, completed = ?, due_date = ?, priority = ?, recurrence = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP, updated_by = ? WHERE " + match + " AND deleted_at IS NULL"
+	args := append([]interface{}{todo.Title, todo.Completed, todo.DueDate, todo.Priority, todo.Recurrence, actorID(ctx)}, matchArgs...)
+	if todo.Version != 0 {
+		query += " AND version = ?"
+		args = append(args, todo.Version)
+	}
+	res, err := store.conn().ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(res)
+	if IsNotFound(err) && todo.Version != 0 {
+		// Nothing matched: either the todo is gone or its version moved on.
+		if _, err := store.GetByID(ctx, todo.ID); err != nil {
+			return err
+		}
+		return ErrVersionConflict
+	}
 	return err
 }
 
-func main() {
+// patchColumns maps the fields UpdateFields accepts to a function that checks
+// and converts the decoded JSON value into what gets stored. Only these names
+// ever reach the SET clause.
+var patchColumns = map[string]func(interface{}) (interface{}, error){
+	"title": func(v interface{}) (interface{}, error) {
+		s, ok := v.(string)
+		if !ok {
+			return nil, &ValidationError{Field: "title", Message: "must be a string"}
+		}
+		return validateTitle(s)
+	},
+	"completed": func(v interface{}) (interface{}, error) {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, &ValidationError{Field: "completed", Message: "must be a boolean"}
+		}
+		return b, nil
+	},
+	"due_date": func(v interface{}) (interface{}, error) {
+		if v == nil {
+			return nil, nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, &ValidationError{Field: "due_date", Message: "must be an RFC3339 timestamp or null"}
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, &ValidationError{Field: "due_date", Message: "must be an RFC3339 timestamp or null"}
+		}
+		return t.UTC(), nil
+	},
+	"priority": func(v interface{}) (interface{}, error) {
+		s, ok := v.(string)
+		if !ok || !contains(priorities, s) {
+			return nil, &ValidationError{Field: "priority", Message: "must be one of " + strings.Join(priorities, ", ")}
+		}
+		return s, nil
+	},
+	"recurrence": func(v interface{}) (interface{}, error) {
+		s, ok := v.(string)
+		if !ok {
+			return nil, &ValidationError{Field: "recurrence", Message: "must be a string"}
+		}
+		return s, validateRecurrence(s)
+	},
+}
 
-	db, err := NewDB("todos.db")
+// convertFields runs each of fields through its patchColumns conversion.
+// Every field that can't be updated or holds an invalid value is reported,
+// in name order, as ValidationErrors.
+func convertFields(fields map[string]interface{}) (map[string]interface{}, error) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make(map[string]interface{}, len(fields))
+	var errs ValidationErrors
+	for _, name := range names {
+		convert, ok := patchColumns[name]
+		if !ok {
+			errs.add(&ValidationError{Field: name, Message: "cannot be updated"})
+			continue
+		}
+		v, err := convert(fields[name])
+		if err != nil {
+			errs.add(err)
+			continue
+		}
+		values[name] = v
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// UpdateFields changes only the given fields of a todo, leaving every other
+// column untouched.
+func (store *TodoSQLStore) UpdateFields(ctx context.Context, id int, fields map[string]interface{}) error {
+	values, err := convertFields(fields)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if len(values) == 0 {
+		_, err := store.GetByID(ctx, id)
+		return err
 	}
-	defer db.Close()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return store.audited(ctx, id, auditUpdated, func(tx *TodoSQLStore) error {
+		return tx.updateFields(ctx, id, names, values)
+	})
+}
 
-	if err := db.EnsureMigration(); err != nil {
-		log.Fatal(err)
+// updateFields writes values, already converted by convertFields, to the
+// columns names lists.
+func (store *TodoSQLStore) updateFields(ctx context.Context, id int, names []string, values map[string]interface{}) error {
+	set := make([]string, len(names), len(names)+3)
+	args := make([]interface{}, 0, len(names)+3)
+	for i, name := range names {
+		set[i] = name + " = ?"
+		args = append(args, values[name])
 	}
+	set = append(set, "version = version + 1", "updated_at = CURRENT_TIMESTAMP", "updated_by = ?")
+	args = append(args, actorID(ctx))
+	match, matchArgs := todoMatch(ctx, id)
+	args = append(args, matchArgs...)
 
-	store := &TodoSQLStore{db}
+	res, err := store.conn().ExecContext(ctx, "UPDATE todos SET "+strings.Join(set, ", ")+" WHERE "+match+" AND deleted_at IS NULL", args...)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
 
-	http.HandleFunc("/todos", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
+// ToggleCompleted flips a todo's completed flag in a single statement, so
+// concurrent toggles can't lose an update between a read and a write.
+func (store *TodoSQLStore) ToggleCompleted(ctx context.Context, id int) (*Todo, error) {
+	match, args := todoMatch(ctx, id)
+	err := store.audited(ctx, id, auditUpdated, func(tx *TodoSQLStore) error {
+		res, err := tx.conn().ExecContext(ctx, "UPDATE todos SET completed = NOT completed, version = version + 1, updated_at = CURRENT_TIMESTAMP, updated_by = ? WHERE "+match+" AND deleted_at IS NULL", append([]interface{}{actorID(ctx)}, args...)...)
+		if err != nil {
+			return err
+		}
+		return checkAffected(res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store.GetByID(ctx, id)
+}
 
-		case http.MethodGet:
-			todos, err := store.GetAll()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			if err := json.NewEncoder(w).Encode(todos); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+// Delete soft-deletes a todo: it is hidden from every other method but kept
+// in the table so RestoreDeleted can bring it back. It returns
+// ErrHasChildren if the todo still has subtasks. Undo can take it back.
+func (store *TodoSQLStore) Delete(ctx context.Context, id int) error {
+	match, args := todoMatch(ctx, id)
+	err := store.audited(ctx, id, auditDeleted, func(tx *TodoSQLStore) error {
+		// Looked up first, so someone else's todo is not found rather than
+		// giving away that it has subtasks.
+		if _, err := tx.GetByID(ctx, id); err != nil {
+			return err
+		}
+		if err := tx.checkNoChildren(ctx, id, false); err != nil {
+			return err
+		}
+		res, err := tx.conn().ExecContext(ctx, "UPDATE todos SET deleted_at = CURRENT_TIMESTAMP WHERE "+match+" AND deleted_at IS NULL", args...)
+		if err != nil {
+			return err
+		}
+		return checkAffected(res)
+	})
+	if err == nil {
+		store.undo.push(ctx, undoEntry{id: id}, undoDepth(store.UndoDepth))
+	}
+	return err
+}
 
-		case http.MethodPost:
-			var todo *Todo
-			if err := json.NewDecoder(r.Body).Decode(&todo); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			todo, err := store.Create(todo.Title)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			if err := json.NewEncoder(w).Encode(todo); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+// HardDelete permanently removes a todo, whether or not it was soft-deleted.
+// Soft-deleted subtasks still reference it, so they block the delete too.
+// The todo is kept in memory so Undo can insert it again.
+func (store *TodoSQLStore) HardDelete(ctx context.Context, id int) error {
+	match, args := todoMatch(ctx, id)
+	var deleted *Todo
+	err := store.audited(ctx, id, auditPurged, func(tx *TodoSQLStore) error {
+		var err error
+		deleted, err = tx.snapshotForUndo(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTodoNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.checkNoChildren(ctx, id, true); err != nil {
+			return err
+		}
+		res, err := tx.conn().ExecContext(ctx, "DELETE FROM todos WHERE "+match, args...)
+		if err != nil {
+			return err
+		}
+		if err := checkAffected(res); err != nil {
+			return err
+		}
+		_, err = tx.conn().ExecContext(ctx, "DELETE FROM todo_tags WHERE todo_id = ?", id)
+		return err
+	})
+	if err == nil {
+		store.undo.push(ctx, undoEntry{id: id, todo: deleted}, undoDepth(store.UndoDepth))
+	}
+	return err
+}
 
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// RestoreDeleted undoes a soft delete. It returns ErrTodoNotFound if the todo
+// does not exist or is not deleted.
+func (store *TodoSQLStore) RestoreDeleted(ctx context.Context, id int) error {
+	match, args := todoMatch(ctx, id)
+	return store.audited(ctx, id, auditRestored, func(tx *TodoSQLStore) error {
+		res, err := tx.conn().ExecContext(ctx, "UPDATE todos SET deleted_at = NULL WHERE "+match+" AND deleted_at IS NOT NULL", args...)
+		if err != nil {
+			return err
 		}
+		return checkAffected(res)
 	})
+}
+
+// Archive hides a todo from lists unless they ask for archived todos,
+// leaving its completed flag alone. Archiving an archived todo is a no-op.
+func (store *TodoSQLStore) Archive(ctx context.Context, id int) error {
+	return store.setArchived(ctx, id, true)
+}
+
+// Unarchive brings an archived todo back into the default lists.
+func (store *TodoSQLStore) Unarchive(ctx context.Context, id int) error {
+	return store.setArchived(ctx, id, false)
+}
 
-	http.HandleFunc("/todos/", func(w http.ResponseWriter, r *http.Request) {
-		id, err := strconv.Atoi(r.URL.Path[len("/todos/"):])
+func (store *TodoSQLStore) setArchived(ctx context.Context, id int, archived bool) error {
+	match, args := todoMatch(ctx, id)
+	return store.audited(ctx, id, auditUpdated, func(tx *TodoSQLStore) error {
+		res, err := tx.conn().ExecContext(ctx, "UPDATE todos SET archived = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP, updated_by = ? WHERE "+match+" AND deleted_at IS NULL", append([]interface{}{archived, actorID(ctx)}, args...)...)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			return err
 		}
+		return checkAffected(res)
+	})
+}
 
-		switch r.Method {
+// DeleteCompleted soft-deletes every completed todo in one statement and
+// returns how many were removed. Todos with subtasks are kept, as Delete
+// would refuse them, and so are archived todos.
+func (store *TodoSQLStore) DeleteCompleted(ctx context.Context) (int, error) {
+	completed := true
+	where, args := scopeFilter(ctx, TodoFilter{Completed: &completed}).where()
+	where += " AND id NOT IN (SELECT parent_id FROM todos WHERE parent_id IS NOT NULL AND deleted_at IS NULL)"
+	var n int
+	err := store.retryTx(ctx, func(tx *TodoSQLStore) error {
+		ids, err := tx.queryIDs(ctx, "UPDATE todos SET deleted_at = CURRENT_TIMESTAMP"+where+" RETURNING id", args...)
+		if err != nil {
+			return err
+		}
+		n = len(ids)
+		return tx.recordDeletes(ctx, ids)
+	})
+	return n, err
+}
 
-		case http.MethodGet:
-			todo, err := store.GetByID(id)
+// DeleteMany soft-deletes the todos with the given IDs in one transaction
+// and returns how many went. IDs that don't exist, are already deleted or
+// belong to another user are ignored, and so is a todo that still has
+// subtasks not being deleted with it. Like DeleteCompleted it leaves nothing
+// for Undo; RestoreDeleted brings the todos back one by one.
+func (store *TodoSQLStore) DeleteMany(ctx context.Context, ids []int) (int, error) {
+	ids = uniqueIDs(ids)
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	where := " WHERE id IN (" + strings.Repeat("?, ", len(ids)-1) + "?) AND deleted_at IS NULL"
+	args := make([]interface{}, 0, len(ids)+1)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	if userID, ok := UserIDFromContext(ctx); ok {
+		where += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	where += " AND id NOT IN (SELECT parent_id FROM todos WHERE parent_id IS NOT NULL AND deleted_at IS NULL)"
+	var n int
+	err := store.retryTx(ctx, func(tx *TodoSQLStore) error {
+		n = 0
+		// Each pass deletes the todos whose subtasks are all gone, so a
+		// parent goes in the pass after the last of its subtasks, however
+		// deep the tree.
+		for {
+			deleted, err := tx.queryIDs(ctx, "UPDATE todos SET deleted_at = CURRENT_TIMESTAMP"+where+" RETURNING id", args...)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return err
 			}
-			if err := json.NewEncoder(w).Encode(todo); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			if len(deleted) == 0 {
+				return nil
 			}
-
-		case http.MethodPut:
-			var todo Todo
-			if err := json.NewDecoder(r.Body).Decode(&todo); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			todo.ID = id
-			if err := store.Update(&todo); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			n += len(deleted)
+			if err := tx.recordDeletes(ctx, deleted); err != nil {
+				return err
 			}
-			if err := json.NewEncoder(w).Encode(todo); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+		}
+	})
+	return n, err
+}
+
+// recordDeletes adds an audit entry for each of ids, which the transaction
+// has just soft-deleted.
+func (store *TodoSQLStore) recordDeletes(ctx context.Context, ids []int) error {
+	for _, id := range ids {
+		deleted, err := store.getAny(ctx, id)
+		if err != nil {
+			return err
+		}
+		diff := map[string]fieldChange{"deleted_at": {From: nil, To: deleted.DeletedAt}}
+		if err := store.recordAudit(ctx, id, actorID(ctx), auditDeleted, diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompleteAll marks every pending todo completed in one statement and
+// returns how many changed. Archived todos are left as they are. Recurring
+// todos get their next occurrence from the usual SpawnRecurring run.
+func (store *TodoSQLStore) CompleteAll(ctx context.Context) (int, error) {
+	pending := false
+	where, args := scopeFilter(ctx, TodoFilter{Completed: &pending}).where()
+	var n int
+	err := store.retryTx(ctx, func(tx *TodoSQLStore) error {
+		ids, err := tx.queryIDs(ctx, "UPDATE todos SET completed = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP, updated_by = ?"+where+" RETURNING id", append([]interface{}{true, actorID(ctx)}, args...)...)
+		if err != nil {
+			return err
+		}
+		n = len(ids)
+		diff := map[string]fieldChange{"completed": {From: false, To: true}}
+		for _, id := range ids {
+			if err := tx.recordAudit(ctx, id, actorID(ctx), auditUpdated, diff); err != nil {
+				return err
 			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// checkAffected turns a statement that touched no rows into ErrTodoNotFound.
+func checkAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTodoNotFound
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
 
-		case http.MethodDelete:
-			if err := store.Delete(id); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+func main() {
+	cfg, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		slog.Error("loading config", "error", err)
+		os.Exit(2)
+	}
+	logger, err := newLogger(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		slog.Error("loading config", "error", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "error", err)
+		os.Exit(1)
+	}
+
+	backend, err := OpenStore(cfg)
+	if err != nil {
+		fatal("opening store", err)
+	}
+	defer func() {
+		if err := backend.Close(); err != nil {
+			logger.Error("closing store", "error", err)
+		}
+		logger.Info("store closed")
+	}()
+	store := backend.Store
+	logger.Info("store opened", "backend", cfg.Store)
+	if cfg.Store == backendMemory {
+		logger.Warn("using the memory store, todos will be lost on exit")
+	}
+
+	// background is cancelled on shutdown to stop long-running goroutines.
+	// workers tracks the ones that use the database, so it isn't closed
+	// under them.
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	var workers sync.WaitGroup
+	startWorker := func(run func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run()
+		}()
+	}
+	var cache *cachingStore
+	if cfg.CacheSize > 0 {
+		cache = newCachingStore(store, cfg.CacheSize)
+		store = cache
+		logger.Info("todo cache enabled", "size", cfg.CacheSize)
+	}
+
+	// The recurrence and reminder jobs need queries only the SQL store has.
+	// Both write, so they don't run in read-only mode.
+	if spawner, ok := backend.Store.(recurrenceSpawner); ok && !cfg.ReadOnly {
+		if cache != nil {
+			spawner = purgingSpawner{recurrenceSpawner: spawner, cache: cache}
+		}
+		startWorker(func() { runRecurrence(background, spawner, recurrenceInterval, logger) })
+	}
+	if overdue, ok := backend.Store.(overdueNotifier); ok && cfg.ReminderInterval > 0 && !cfg.ReadOnly {
+		var notifier Notifier = LogNotifier{Logger: logger}
+		if cfg.ReminderWebhookURL != "" {
+			notifier = WebhookNotifier{URL: cfg.ReminderWebhookURL}
+		}
+		startWorker(func() { runReminders(background, overdue, notifier, cfg.ReminderInterval, logger) })
+	}
+
+	if len(cfg.APIKeys) == 0 {
+		logger.Warn("no API keys configured, authentication is disabled")
+	}
+
+	events := newBroker()
+	if len(cfg.WebhookURLs) > 0 {
+		go runWebhooks(background, events, cfg.WebhookURLs, logger)
+	}
+
+	pages := PageSizes{Default: cfg.DefaultPageSize, Max: cfg.MaxPageSize}
+	timezone, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		fatal("loading time zone", err)
+	}
+	handler := NewRouter(store, backend.DB, events, RouterOptions{Pages: pages, Timezone: timezone, IDStrategy: cfg.IDStrategy, ReadOnly: cfg.ReadOnly})
+	handler = withTimeout(cfg.RequestTimeout)(handler)
+	handler = limitBody(cfg.MaxBodyBytes)(handler)
+	// readOnly goes inside authentication, so a write without credentials
+	// is refused with 401 rather than told to come back later.
+	handler = readOnly(cfg.ReadOnly)(handler)
+	if cfg.ReadOnly {
+		logger.Warn("read-only mode, writes are refused with 503 over HTTP and Unavailable over gRPC")
+	}
+	handler = requireAdmin(cfg.AdminAPIKeys)(handler)
+	handler = requireJWT([]byte(cfg.JWTSecret))(handler)
+	handler = requireAPIKey(cfg.APIKeys)(handler)
+	if cfg.RateLimit > 0 {
+		limiter := newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+		go limiter.run(background)
+		handler = limiter.Middleware(handler)
+	}
+	handler = cors(cfg.AllowedOrigins)(handler)
+	handler = recoverPanics(logger)(handler)
+	if cfg.CompressionLevel != 0 {
+		handler = compress(cfg.CompressionLevel)(handler)
+	}
+	handler = mountAt(cfg.BasePath)(handler)
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           assignRequestID(logRequests(logger)(handler)),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddr != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			fatal("listening for gRPC", err)
+		}
+		grpcServer = NewGRPCServer(store, events, GRPCOptions{
+			APIKeys:        cfg.APIKeys,
+			JWTSecret:      []byte(cfg.JWTSecret),
+			RequestTimeout: cfg.RequestTimeout,
+			Pages:          pages,
+			ReadOnly:       cfg.ReadOnly,
+			IDStrategy:     cfg.IDStrategy,
+		}, logger)
+		go func() {
+			logger.Info("gRPC listening", "addr", cfg.GRPCAddr)
+			if err := grpcServer.Serve(lis); err != nil {
+				fatal("serving gRPC", err)
 			}
+		}()
+	}
 
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	go func() {
+		logger.Info("listening", "addr", cfg.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("serving HTTP", err)
 		}
-	})
+	}()
 
-	log.Println("Listening on :8080...")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+
+	logger.Info("shutting down", "signal", sig.String())
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("shutting down HTTP server", "error", err)
+	}
+	if grpcServer != nil {
+		stopGRPC(ctx, grpcServer)
+	}
+	stopBackground()
+	workers.Wait()
+	logger.Info("HTTP server stopped, closing store")
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDB opens a migrated SQLite database in a temporary directory that
+// is removed when the test ends.
+func newTestDB(tb testing.TB) *DB {
+	tb.Helper()
+	db, err := NewDB(filepath.Join(tb.TempDir(), "todos.db"), DBOptions{})
+	if err != nil {
+		tb.Fatalf("NewDB: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	if err := db.EnsureMigration(); err != nil {
+		tb.Fatalf("EnsureMigration: %v", err)
+	}
+	return db
+}
+
+// newTestSQLStore returns a TodoSQLStore on a fresh database from newTestDB.
+func newTestSQLStore(tb testing.TB) *TodoSQLStore {
+	tb.Helper()
+	store, err := NewTodoSQLStore(newTestDB(tb))
+	if err != nil {
+		tb.Fatalf("NewTodoSQLStore: %v", err)
+	}
+	tb.Cleanup(func() { store.Close() })
+	return store
+}
+
+// eachStore runs test as a subtest against a fresh store of every kind.
+func eachStore(t *testing.T, test func(t *testing.T, store TodoStore)) {
+	t.Run("sql", func(t *testing.T) { test(t, newTestSQLStore(t)) })
+	t.Run("memory", func(t *testing.T) { test(t, NewInMemoryTodoStore()) })
+}
+
+// mustCreate creates a todo titled title, as a subtask of parent unless it
+// is nil, and fails the test if that doesn't work.
+func mustCreate(t *testing.T, ctx context.Context, store TodoStore, title string, parent *Todo) *Todo {
+	t.Helper()
+	todo := &Todo{Title: title}
+	if parent != nil {
+		todo.ParentID = &parent.ID
+	}
+	created, err := store.Create(ctx, todo)
+	if err != nil {
+		t.Fatalf("Create(%q): %v", title, err)
+	}
+	return created
+}
+
+func TestDeleteWithChildren(t *testing.T) {
+	eachStore(t, func(t *testing.T, store TodoStore) {
+		ctx := context.Background()
+		parent := mustCreate(t, ctx, store, "parent", nil)
+		child := mustCreate(t, ctx, store, "child", parent)
+
+		if err := store.Delete(ctx, parent.ID); !errors.Is(err, ErrHasChildren) {
+			t.Fatalf("Delete(parent) = %v, want ErrHasChildren", err)
+		}
+		if err := store.HardDelete(ctx, parent.ID); !errors.Is(err, ErrHasChildren) {
+			t.Fatalf("HardDelete(parent) = %v, want ErrHasChildren", err)
+		}
+		if _, err := store.GetByID(ctx, parent.ID); err != nil {
+			t.Fatalf("GetByID(parent) after refused deletes: %v", err)
+		}
+
+		// A soft-deleted subtask still references its parent, so only a
+		// soft delete of the parent goes through.
+		if err := store.Delete(ctx, child.ID); err != nil {
+			t.Fatalf("Delete(child): %v", err)
+		}
+		if err := store.HardDelete(ctx, parent.ID); !errors.Is(err, ErrHasChildren) {
+			t.Fatalf("HardDelete(parent) with a soft-deleted child = %v, want ErrHasChildren", err)
+		}
+		if err := store.Delete(ctx, parent.ID); err != nil {
+			t.Fatalf("Delete(parent) with a soft-deleted child: %v", err)
+		}
+
+		if err := store.HardDelete(ctx, child.ID); err != nil {
+			t.Fatalf("HardDelete(child): %v", err)
+		}
+		if err := store.HardDelete(ctx, parent.ID); err != nil {
+			t.Fatalf("HardDelete(parent) without children: %v", err)
+		}
+		if _, err := store.GetByID(ctx, parent.ID); !errors.Is(err, ErrTodoNotFound) {
+			t.Fatalf("GetByID(parent) after HardDelete = %v, want ErrTodoNotFound", err)
+		}
+	})
+}
+
+func TestDeleteOtherUsersParent(t *testing.T) {
+	eachStore(t, func(t *testing.T, store TodoStore) {
+		alice := WithUserID(context.Background(), "alice")
+		bob := WithUserID(context.Background(), "bob")
+		parent := mustCreate(t, alice, store, "parent", nil)
+		mustCreate(t, alice, store, "child", parent)
+
+		if err := store.Delete(bob, parent.ID); !errors.Is(err, ErrTodoNotFound) {
+			t.Errorf("Delete by another user = %v, want ErrTodoNotFound", err)
+		}
+		if err := store.HardDelete(bob, parent.ID); !errors.Is(err, ErrTodoNotFound) {
+			t.Errorf("HardDelete by another user = %v, want ErrTodoNotFound", err)
+		}
+		if err := store.Delete(alice, parent.ID); !errors.Is(err, ErrHasChildren) {
+			t.Errorf("Delete by the owner = %v, want ErrHasChildren", err)
+		}
+	})
+}
+
+func TestDeleteTodoStatus(t *testing.T) {
+	store := newTestSQLStore(t)
+	ctx := context.Background()
+	parent := mustCreate(t, ctx, store, "parent", nil)
+	mustCreate(t, ctx, store, "child", parent)
+	for _, c := range []struct {
+		target string
+		id     string
+		want   int
+	}{
+		{"/todos/999", "999", http.StatusNotFound},
+		{"/todos/999?permanent=true", "999", http.StatusNotFound},
+		{"/todos/1", "1", http.StatusConflict},
+		{"/todos/1?permanent=true", "1", http.StatusConflict},
+	} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodDelete, c.target, nil)
+		r.SetPathValue("id", c.id)
+		deleteTodo(store)(rec, r)
+		if rec.Code != c.want {
+			t.Errorf("DELETE %s: status = %d, want %d", c.target, rec.Code, c.want)
+		}
+	}
+}
+
+// assertNoTodos fails the test if store has any todos left.
+func assertNoTodos(t *testing.T, store TodoStore) {
+	t.Helper()
+	ctx := context.Background()
+	n, err := store.Count(ctx, TodoFilter{})
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	todos, err := store.GetAll(ctx, ListOptions{Limit: 10, Sort: "id", Order: "asc"})
+	if err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if n != 0 || len(todos) != 0 {
+		t.Fatalf("Count = %d and GetAll returned %d todos after rollback, want none", n, len(todos))
+	}
+}
+
+func TestWithTxRollsBackOnError(t *testing.T) {
+	store := newTestSQLStore(t)
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+	err := store.WithTx(ctx, func(tx *TodoSQLStore) error {
+		mustCreate(t, ctx, tx, "first", nil)
+		mustCreate(t, ctx, tx, "second", nil)
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("WithTx = %v, want the error fn returned", err)
+	}
+	assertNoTodos(t, store)
+}
+
+func TestWithTxRollsBackOnPanic(t *testing.T) {
+	store := newTestSQLStore(t)
+	ctx := context.Background()
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Fatalf("recovered %v, want WithTx to re-panic with boom", p)
+			}
+		}()
+		store.WithTx(ctx, func(tx *TodoSQLStore) error {
+			mustCreate(t, ctx, tx, "first", nil)
+			panic("boom")
+		})
+	}()
+	assertNoTodos(t, store)
+}
+
+func TestWithTxCommits(t *testing.T) {
+	store := newTestSQLStore(t)
+	ctx := context.Background()
+	err := store.WithTx(ctx, func(tx *TodoSQLStore) error {
+		mustCreate(t, ctx, tx, "first", nil)
+		mustCreate(t, ctx, tx, "second", nil)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	if n, err := store.Count(ctx, TodoFilter{}); err != nil || n != 2 {
+		t.Fatalf("Count = %d, %v; want 2 committed todos", n, err)
+	}
+}
+
+// adHocStore returns a store on db that runs every query ad hoc, the way
+// NewTodoSQLStore's store would without its prepared statements.
+func adHocStore(db *DB) *TodoSQLStore {
+	return &TodoSQLStore{DB: db, stmts: map[string]*sql.Stmt{}, undo: newUndoStack()}
+}
+
+// benchSQLStores runs bench as a sub-benchmark against a store with
+// preparedQueries prepared and against one without.
+func benchSQLStores(b *testing.B, bench func(b *testing.B, store *TodoSQLStore)) {
+	b.Run("prepared", func(b *testing.B) { bench(b, newTestSQLStore(b)) })
+	b.Run("ad-hoc", func(b *testing.B) { bench(b, adHocStore(newTestDB(b))) })
+}
+
+func BenchmarkPreparedGetByID(b *testing.B) {
+	benchSQLStores(b, func(b *testing.B, store *TodoSQLStore) {
+		ctx := context.Background()
+		todo, err := store.Create(ctx, &Todo{Title: "bench"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for b.Loop() {
+			if _, err := store.GetByID(ctx, todo.ID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPreparedCreate(b *testing.B) {
+	benchSQLStores(b, func(b *testing.B, store *TodoSQLStore) {
+		ctx := context.Background()
+		for b.Loop() {
+			if _, err := store.Create(ctx, &Todo{Title: "bench"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCreateBulkReportsEveryItem(t *testing.T) {
+	eachStore(t, func(t *testing.T, store TodoStore) {
+		_, err := store.CreateBulk(context.Background(), []*Todo{{Title: ""}, {Title: "ok", Priority: "bad"}})
+		var fields []string
+		for _, e := range validationErrors(err) {
+			fields = append(fields, e.Field)
+		}
+		if len(fields) != 2 || fields[0] != "[0].title" || fields[1] != "[1].priority" {
+			t.Errorf("CreateBulk errors = %v, want [0].title and [1].priority", fields)
+		}
+		assertNoTodos(t, store)
+	})
+}
+
+func TestTagEditsAreVersionedAndAudited(t *testing.T) {
+	eachStore(t, func(t *testing.T, store TodoStore) {
+		ctx := context.Background()
+		todo := mustCreate(t, ctx, store, "tagged", nil)
+		for _, edit := range []func() error{
+			func() error { return store.AddTag(ctx, todo.ID, "Work") },
+			func() error { return store.AddTag(ctx, todo.ID, "work") },
+			func() error { return store.RemoveTag(ctx, todo.ID, "work") },
+			func() error { return store.RemoveTag(ctx, todo.ID, "work") },
+		} {
+			if err := edit(); err != nil {
+				t.Fatalf("editing tags: %v", err)
+			}
+		}
+		got, err := store.GetByID(ctx, todo.ID)
+		if err != nil {
+			t.Fatalf("GetByID: %v", err)
+		}
+		if got.Version != todo.Version+2 {
+			t.Errorf("version = %d, want %d: bumped by the add and the remove only", got.Version, todo.Version+2)
+		}
+		entries, err := store.History(ctx, todo.ID)
+		if err != nil {
+			t.Fatalf("History: %v", err)
+		}
+		var tagEdits int
+		for _, entry := range entries {
+			if _, ok := entry.Diff["tags"]; ok && entry.Action == auditUpdated {
+				tagEdits++
+			}
+		}
+		if tagEdits != 2 {
+			t.Errorf("history = %+v, want two tag updates", entries)
+		}
+	})
+}
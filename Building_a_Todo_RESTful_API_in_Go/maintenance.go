@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Maintain compacts the database and refreshes the query planner's
+// statistics: VACUUM and ANALYZE on SQLite, followed by a checkpoint that
+// truncates the WAL so the file actually shrinks, and VACUUM ANALYZE on
+// Postgres. Each statement runs on its own outside any transaction, which
+// VACUUM requires; with SQLite's single pooled connection, requests queue
+// behind it rather than deadlocking, so callers must not hold a
+// transaction or open rows while calling it.
+func (db *DB) Maintain(ctx context.Context) error {
+	statements := []string{"VACUUM ANALYZE"}
+	if db.Driver == driverSQLite {
+		statements = []string{"VACUUM", "ANALYZE", "PRAGMA wal_checkpoint(TRUNCATE)"}
+	}
+	for _, stmt := range statements {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns how many bytes the database takes up: its pages on SQLite,
+// not counting the WAL, and pg_database_size on Postgres.
+func (db *DB) Size(ctx context.Context) (int64, error) {
+	var size int64
+	query := "SELECT pg_database_size(current_database())"
+	if db.Driver == driverSQLite {
+		query = "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()"
+	}
+	err := db.QueryRowContext(ctx, query).Scan(&size)
+	return size, err
+}
+
+// runMaintenance serves POST /admin/maintenance: it runs Maintain and
+// reports how long it took and the database size before and after.
+func runMaintenance(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		before, err := db.Size(r.Context())
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		start := time.Now()
+		if err := db.Maintain(r.Context()); err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		took := time.Since(start)
+		after, err := db.Size(r.Context())
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		slog.InfoContext(r.Context(), "database maintenance done", "duration", took, "size_before", before, "size_after", after)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"duration_ms": took.Milliseconds(),
+			"size_before": before,
+			"size_after":  after,
+		})
+	}
+}
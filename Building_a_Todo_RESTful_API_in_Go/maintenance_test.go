@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReadOnlyRefusesGraphQLMutations(t *testing.T) {
+	store := NewInMemoryTodoStore()
+	h := serveGraphQL(store, RouterOptions{ReadOnly: true})
+	var resp struct {
+		Data   map[string]interface{}
+		Errors []struct {
+			Extensions struct{ Code string }
+		}
+	}
+	rec := serve(h, http.MethodPost, "/graphql", `{"query": "{ todos { total } }"}`)
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || len(resp.Errors) > 0 || resp.Data["todos"] == nil {
+		t.Errorf("query: %+v, %v; want it answered", resp, err)
+	}
+	resp.Errors = nil
+	rec = serve(h, http.MethodPost, "/graphql", `{"query": "mutation { createTodo(input: {title: \"x\"}) { title } }"}`)
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || len(resp.Errors) != 1 || resp.Errors[0].Extensions.Code != "read_only" {
+		t.Errorf("mutation: %+v, %v; want a read_only error", resp, err)
+	}
+	if n, err := store.Count(context.Background(), TodoFilter{}); err != nil || n != 0 {
+		t.Errorf("Count = %d, %v; want no todo created", n, err)
+	}
+}
+
+func TestReadOnlyRefusesWebSocketCommands(t *testing.T) {
+	store := NewInMemoryTodoStore()
+	srv := httptest.NewServer(serveWebSocket(store, newBroker(), RouterOptions{ReadOnly: true}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(wsCommand{Type: "create", Ref: "1", Todo: []byte(`{"title":"x"}`)}); err != nil {
+		t.Fatalf("sending create: %v", err)
+	}
+	var reply wsReply
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("reading the reply: %v", err)
+	}
+	if reply.Type != "error" || reply.Ref != "1" || reply.Error == nil || reply.Error.Code != "read_only" {
+		t.Errorf("reply = %+v, want a read_only error for ref 1", reply)
+	}
+	if n, err := store.Count(context.Background(), TodoFilter{}); err != nil || n != 0 {
+		t.Errorf("Count = %d, %v; want no todo created", n, err)
+	}
+}
+
+func TestGRPCReadOnly(t *testing.T) {
+	intercept := grpcReadOnly(true)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	for _, method := range grpcReadMethods {
+		if _, err := intercept(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler); err != nil {
+			t.Errorf("%s: %v, want it let through", method, err)
+		}
+	}
+	for _, method := range []string{TodoService_Create_FullMethodName, TodoService_Update_FullMethodName, TodoService_Delete_FullMethodName} {
+		_, err := intercept(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("%s: %v, want Unavailable", method, err)
+		}
+	}
+}
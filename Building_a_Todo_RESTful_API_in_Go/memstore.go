@@ -0,0 +1,856 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InMemoryTodoStore is a TodoStore kept in a map, for exercising handlers
+// without a database. It follows the SQL store's rules, including per-user
+// scoping, soft deletes, versions and the ErrTodoNotFound sentinel.
+type InMemoryTodoStore struct {
+	mu     sync.Mutex
+	nextID int
+	todos  map[int]*memTodo
+	keys   map[memKey]memKeyEntry
+	// IdempotencyTTL is how long CreateIdempotent remembers a key; zero
+	// means defaultIdempotencyTTL.
+	IdempotencyTTL time.Duration
+	// UndoDepth is how many deletes per user Undo can take back; zero means
+	// defaultUndoDepth.
+	UndoDepth int
+	// IDStrategy is one of idStrategies; under idUUID and idULID, Create
+	// generates an external ID for todos created without one.
+	IDStrategy string
+	// Quota limits how many todos Create lets each user have.
+	Quota TodoQuota
+	undo  *undoStack
+	audit []memAudit
+}
+
+var _ TodoStore = (*InMemoryTodoStore)(nil)
+
+// memTodo is a stored todo plus the columns Todo doesn't expose.
+type memTodo struct {
+	Todo
+	userID string
+	tags   []string
+}
+
+func NewInMemoryTodoStore() *InMemoryTodoStore {
+	return &InMemoryTodoStore{nextID: 1, todos: make(map[int]*memTodo), keys: make(map[memKey]memKeyEntry), undo: newUndoStack()}
+}
+
+// memAudit is an audit log entry plus the owner History scopes it by.
+type memAudit struct {
+	AuditEntry
+	owner string
+}
+
+// record appends an entry for a change to t from before to after, either of
+// which is nil where the todo didn't exist. The caller holds mu.
+func (s *InMemoryTodoStore) record(ctx context.Context, action string, t *memTodo, before, after *Todo) {
+	s.recordDiff(ctx, action, t, todoDiff(before, after))
+}
+
+// recordDiff is record for a change todoDiff doesn't see, such as to tags.
+func (s *InMemoryTodoStore) recordDiff(ctx context.Context, action string, t *memTodo, diff map[string]fieldChange) {
+	id := 1
+	if n := len(s.audit); n > 0 {
+		id = s.audit[n-1].ID + 1
+	}
+	s.audit = append(s.audit, memAudit{AuditEntry: AuditEntry{
+		ID:        id,
+		TodoID:    t.ID,
+		Action:    action,
+		Actor:     actorID(ctx),
+		Timestamp: memNow(),
+		Diff:      diff,
+	}, owner: t.userID})
+}
+
+// memNow matches CURRENT_TIMESTAMP, which only has second precision.
+func memNow() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// copyPtr keeps the store from sharing memory with the caller's todo.
+func copyPtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+// snapshot returns a copy of the todo that callers are free to modify.
+func (t *memTodo) snapshot() *Todo {
+	todo := t.Todo
+	return &todo
+}
+
+// visible reports whether the user in ctx, if any, owns t.
+func visible(ctx context.Context, t *memTodo) bool {
+	userID, ok := UserIDFromContext(ctx)
+	return !ok || t.userID == userID
+}
+
+// get returns the live todo id as seen from ctx. The caller holds mu.
+func (s *InMemoryTodoStore) get(ctx context.Context, id int) (*memTodo, error) {
+	t, ok := s.todos[id]
+	if !ok || t.DeletedAt != nil || !visible(ctx, t) {
+		return nil, ErrTodoNotFound
+	}
+	return t, nil
+}
+
+func (f TodoFilter) matches(t *memTodo) bool {
+	switch {
+	case !f.IncludeDeleted && t.DeletedAt != nil,
+		f.UserID != "" && t.userID != f.UserID,
+		f.Completed != nil && t.Completed != *f.Completed,
+		f.Priority != "" && t.Priority != f.Priority,
+		len(f.Priorities) > 0 && !contains(f.Priorities, t.Priority),
+		f.Recurring != nil && (t.Recurrence != recurrenceNone) != *f.Recurring,
+		t.Archived != f.Archived,
+		f.CreatedAfter != nil && t.CreatedAt.Before(*f.CreatedAfter),
+		f.CreatedBefore != nil && !t.CreatedAt.Before(*f.CreatedBefore),
+		f.DueAfter != nil && (t.DueDate == nil || t.DueDate.Before(*f.DueAfter)),
+		f.DueBefore != nil && (t.DueDate == nil || !t.DueDate.Before(*f.DueBefore)),
+		f.Overdue != nil && (!t.Completed && t.DueDate != nil && t.DueDate.Before(f.overdueAt())) != *f.Overdue,
+		f.Tag != "" && !contains(t.tags, f.Tag),
+		f.Query != "" && !strings.Contains(strings.ToLower(t.Title), strings.ToLower(f.Query)):
+		return false
+	}
+	return true
+}
+
+// filter returns the todos matching filter, scoped to the user in ctx, in
+// id order. The caller holds mu.
+func (s *InMemoryTodoStore) filter(ctx context.Context, filter TodoFilter) []*memTodo {
+	return s.matching(scopeFilter(ctx, filter))
+}
+
+// matching is filter across every user's todos. The caller holds mu.
+func (s *InMemoryTodoStore) matching(filter TodoFilter) []*memTodo {
+	var matched []*memTodo
+	for _, t := range s.todos {
+		if filter.matches(t) {
+			matched = append(matched, t)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID < matched[j].ID })
+	return matched
+}
+
+// memLess orders two todos by one of sortColumns, ascending.
+func memLess(column string, a, b *memTodo) bool {
+	switch column {
+	case "title":
+		return a.Title < b.Title
+	case "completed":
+		return !a.Completed && b.Completed
+	case "created_at":
+		return a.CreatedAt.Before(b.CreatedAt)
+	case "updated_at":
+		return a.UpdatedAt.Before(b.UpdatedAt)
+	case "due_date":
+		// As in orderBy, no due date sorts last.
+		return a.DueDate != nil && (b.DueDate == nil || a.DueDate.Before(*b.DueDate))
+	case "position":
+		return a.Position < b.Position
+	}
+	return a.ID < b.ID
+}
+
+func (s *InMemoryTodoStore) GetAll(ctx context.Context, opts ListOptions) ([]*Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	opts.TodoFilter = scopeFilter(ctx, opts.TodoFilter)
+	var todos []*Todo
+	for _, t := range s.page(opts) {
+		todos = append(todos, t.snapshot())
+	}
+	return todos, nil
+}
+
+// GetAllUnscoped is the InMemoryTodoStore version.
+func (s *InMemoryTodoStore) GetAllUnscoped(ctx context.Context, opts ListOptions) ([]*OwnedTodo, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var todos []*OwnedTodo
+	for _, t := range s.page(opts) {
+		owned := &OwnedTodo{Todo: t.snapshot()}
+		if t.userID != "" {
+			owned.UserID = copyPtr(&t.userID)
+		}
+		todos = append(todos, owned)
+	}
+	return todos, len(s.matching(opts.TodoFilter)), nil
+}
+
+// page returns the todos of opts, across every user's; callers scope opts
+// first. The caller holds mu.
+func (s *InMemoryTodoStore) page(opts ListOptions) []*memTodo {
+	var matched []*memTodo
+	for _, t := range s.matching(opts.TodoFilter) {
+		if t.ID > opts.After {
+			matched = append(matched, t)
+		}
+	}
+	// Swapping the operands for desc reverses the id tiebreaker too, as in
+	// orderBy.
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if opts.Order == "desc" {
+			a, b = b, a
+		}
+		if memLess(opts.Sort, a, b) {
+			return true
+		}
+		if memLess(opts.Sort, b, a) {
+			return false
+		}
+		return a.ID < b.ID
+	})
+
+	start := min(opts.Offset, len(matched))
+	end := min(start+opts.Limit, len(matched))
+	return matched[start:end]
+}
+
+func (s *InMemoryTodoStore) Count(ctx context.Context, filter TodoFilter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.filter(ctx, filter)), nil
+}
+
+// ForEach calls fn on a snapshot taken up front, so fn may use the store.
+func (s *InMemoryTodoStore) ForEach(ctx context.Context, filter TodoFilter, fn func(*Todo) error) error {
+	s.mu.Lock()
+	var todos []*Todo
+	for _, t := range s.filter(ctx, filter) {
+		todos = append(todos, t.snapshot())
+	}
+	s.mu.Unlock()
+
+	for _, todo := range todos {
+		if err := fn(todo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryTodoStore) GetByID(ctx context.Context, id int) (*Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return t.snapshot(), nil
+}
+
+func (s *InMemoryTodoStore) GetByIDs(ctx context.Context, ids []int) ([]*Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	todos := []*Todo{}
+	for _, id := range uniqueIDs(ids) {
+		if t, err := s.get(ctx, id); err == nil {
+			todos = append(todos, t.snapshot())
+		}
+	}
+	return todos, nil
+}
+
+// create validates and stores a new todo. For an external ID the user
+// already has it returns that todo, with fresh false so callers undoing a
+// failed batch leave it alone. The caller holds mu.
+func (s *InMemoryTodoStore) create(ctx context.Context, todo *Todo) (t *memTodo, fresh bool, err error) {
+	if todo.ExternalID == nil {
+		todo.ExternalID = newExternalID(s.IDStrategy)
+	}
+	if err := todo.validate(); err != nil {
+		return nil, false, err
+	}
+	if todo.ParentID != nil {
+		if _, err := s.get(ctx, *todo.ParentID); err != nil {
+			return nil, false, errNoParent
+		}
+	}
+	if existing, err := s.byExternalID(ctx, todo.ExternalID); existing != nil || err != nil {
+		return existing, false, err
+	}
+	if err := s.checkQuota(ctx); err != nil {
+		return nil, false, err
+	}
+	now := memNow()
+	t = &memTodo{Todo: Todo{
+		ID:         s.nextID,
+		Title:      todo.Title,
+		Completed:  todo.Completed,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		DueDate:    copyPtr(todo.DueDate),
+		Priority:   todo.Priority,
+		Recurrence: todo.Recurrence,
+		ParentID:   copyPtr(todo.ParentID),
+		ExternalID: copyPtr(todo.ExternalID),
+		Version:    1,
+		CreatedBy:  actorID(ctx),
+		UpdatedBy:  actorID(ctx),
+	}}
+	t.userID, _ = UserIDFromContext(ctx)
+	t.Position = s.nextPosition(t.userID)
+	s.todos[t.ID] = t
+	s.nextID++
+	s.record(ctx, auditCreated, t, nil, t.snapshot())
+	return t, true, nil
+}
+
+func (s *InMemoryTodoStore) Create(ctx context.Context, todo *Todo) (*Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, _, err := s.create(ctx, todo)
+	if err != nil {
+		return nil, err
+	}
+	return t.snapshot(), nil
+}
+
+// memKey is an idempotency key in the namespace of the user who sent it.
+type memKey struct {
+	owner, key string
+}
+
+type memKeyEntry struct {
+	todoID  int
+	created time.Time
+}
+
+func (s *InMemoryTodoStore) CreateIdempotent(ctx context.Context, key string, todo *Todo) (*Todo, bool, error) {
+	if err := validateIdempotencyKey(key); err != nil {
+		return nil, false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-idempotencyTTL(s.IdempotencyTTL))
+	for k, e := range s.keys {
+		if e.created.Before(cutoff) {
+			delete(s.keys, k)
+		}
+	}
+
+	owner, _ := UserIDFromContext(ctx)
+	k := memKey{owner, key}
+	// A hard delete drops the key with the todo, as the foreign key does.
+	if e, ok := s.keys[k]; ok && s.todos[e.todoID] != nil {
+		t, err := s.get(ctx, e.todoID)
+		if err != nil {
+			return nil, false, err
+		}
+		return t.snapshot(), true, nil
+	}
+	t, _, err := s.create(ctx, todo)
+	if err != nil {
+		return nil, false, err
+	}
+	s.keys[k] = memKeyEntry{todoID: t.ID, created: time.Now()}
+	return t.snapshot(), false, nil
+}
+
+// CreateBulk inserts all todos or, if one fails validation, none of them.
+func (s *InMemoryTodoStore) CreateBulk(ctx context.Context, todos []*Todo) ([]*Todo, error) {
+	if err := validateBulk(todos); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	created := make([]*Todo, 0, len(todos))
+	var inserted []*Todo
+	for i, todo := range todos {
+		t, fresh, err := s.create(ctx, todo)
+		if errs := validationErrors(err); errs != nil {
+			s.remove(inserted)
+			return nil, errs.prefixed(fmt.Sprintf("[%d].", i))
+		}
+		if err != nil {
+			s.remove(inserted)
+			return nil, err
+		}
+		created = append(created, t.snapshot())
+		if fresh {
+			inserted = append(inserted, t.snapshot())
+		}
+	}
+	return created, nil
+}
+
+// remove undoes a partial insert. The caller holds mu.
+func (s *InMemoryTodoStore) remove(todos []*Todo) {
+	removed := make(map[int]bool, len(todos))
+	for _, todo := range todos {
+		delete(s.todos, todo.ID)
+		removed[todo.ID] = true
+	}
+	kept := s.audit[:0]
+	for _, entry := range s.audit {
+		if !removed[entry.TodoID] {
+			kept = append(kept, entry)
+		}
+	}
+	s.audit = kept
+}
+
+// Import creates todos from next like the SQL store does. Rows become
+// visible as they are inserted rather than all at once, but an aborted
+// import or a dry run still removes them again.
+func (s *InMemoryTodoStore) Import(ctx context.Context, next func() (*Todo, error), opts ImportOptions) (*ImportResult, error) {
+	result := newImportResult(opts)
+	var created []*Todo
+	for row := 1; ; row++ {
+		todo, err := next()
+		if err == io.EOF {
+			if opts.DryRun {
+				s.mu.Lock()
+				s.remove(created)
+				s.mu.Unlock()
+			}
+			return result, nil
+		}
+		fresh := false
+		if err == nil {
+			var t *memTodo
+			s.mu.Lock()
+			if t, fresh, err = s.create(ctx, todo); err == nil {
+				todo = t.snapshot()
+			}
+			s.mu.Unlock()
+		}
+		if err != nil && !IsValidationError(err) {
+			s.mu.Lock()
+			s.remove(created)
+			s.mu.Unlock()
+			return nil, err
+		}
+		if fresh {
+			created = append(created, todo)
+		}
+		result.addRow(row, err)
+	}
+}
+
+func (s *InMemoryTodoStore) Update(ctx context.Context, todo *Todo) error {
+	if err := todo.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.get(ctx, todo.ID)
+	if err != nil {
+		return err
+	}
+	if todo.Version != 0 && todo.Version != t.Version {
+		return ErrVersionConflict
+	}
+	before := t.snapshot()
+	t.Title = todo.Title
+	t.Completed = todo.Completed
+	t.DueDate = copyPtr(todo.DueDate)
+	t.Priority = todo.Priority
+	t.Recurrence = todo.Recurrence
+	t.touch(ctx)
+	s.record(ctx, auditUpdated, t, before, t.snapshot())
+	return nil
+}
+
+// touch records a change by the user in ctx the way every SQL UPDATE does.
+func (t *memTodo) touch(ctx context.Context) {
+	t.Version++
+	t.UpdatedAt = memNow()
+	t.UpdatedBy = actorID(ctx)
+}
+
+func (s *InMemoryTodoStore) UpdateFields(ctx context.Context, id int, fields map[string]interface{}) error {
+	values, err := convertFields(fields)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.get(ctx, id)
+	if err != nil || len(values) == 0 {
+		return err
+	}
+	before := t.snapshot()
+	setFields(&t.Todo, values)
+	t.touch(ctx)
+	s.record(ctx, auditUpdated, t, before, t.snapshot())
+	return nil
+}
+
+func (s *InMemoryTodoStore) ToggleCompleted(ctx context.Context, id int) (*Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	before := t.snapshot()
+	t.Completed = !t.Completed
+	t.touch(ctx)
+	s.record(ctx, auditUpdated, t, before, t.snapshot())
+	return t.snapshot(), nil
+}
+
+// hasChildren reports whether any todo has id as its parent, counting
+// soft-deleted ones only if includeDeleted is set. The caller holds mu
+// and has checked that todo id is visible.
+func (s *InMemoryTodoStore) hasChildren(id int, includeDeleted bool) bool {
+	for _, t := range s.todos {
+		if t.ParentID != nil && *t.ParentID == id && (includeDeleted || t.DeletedAt == nil) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *InMemoryTodoStore) Delete(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if s.hasChildren(id, false) {
+		return ErrHasChildren
+	}
+	before := t.snapshot()
+	now := memNow()
+	t.DeletedAt = &now
+	s.record(ctx, auditDeleted, t, before, t.snapshot())
+	s.undo.push(ctx, undoEntry{id: id}, undoDepth(s.UndoDepth))
+	return nil
+}
+
+func (s *InMemoryTodoStore) HardDelete(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.todos[id]
+	if !ok || !visible(ctx, t) {
+		return ErrTodoNotFound
+	}
+	if s.hasChildren(id, true) {
+		return ErrHasChildren
+	}
+	delete(s.todos, id)
+	s.record(ctx, auditPurged, t, t.snapshot(), nil)
+	deleted := t.snapshot()
+	deleted.Tags = append([]string(nil), t.tags...)
+	s.undo.push(ctx, undoEntry{id: id, todo: deleted}, undoDepth(s.UndoDepth))
+	return nil
+}
+
+// Undo mirrors TodoSQLStore.Undo.
+func (s *InMemoryTodoStore) Undo(ctx context.Context) (*Todo, error) {
+	return undoLatest(ctx, s.undo, undoDepth(s.UndoDepth), func(entry undoEntry) (*Todo, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if entry.todo == nil {
+			t, ok := s.todos[entry.id]
+			if !ok || t.DeletedAt == nil || !visible(ctx, t) {
+				return nil, ErrTodoNotFound
+			}
+			before := t.snapshot()
+			t.DeletedAt = nil
+			s.record(ctx, auditRestored, t, before, t.snapshot())
+			return t.snapshot(), nil
+		}
+		old := entry.todo
+		t := &memTodo{Todo: *old, tags: old.Tags}
+		t.ID = s.nextID
+		t.Tags = nil
+		t.DeletedAt = nil
+		t.UpdatedAt = memNow()
+		t.UpdatedBy = actorID(ctx)
+		t.Version = 1
+		for _, other := range s.todos {
+			if t.ExternalID != nil && other.ExternalID != nil && *other.ExternalID == *t.ExternalID {
+				// Another todo took the external ID while this one was gone.
+				t.ExternalID = nil
+			}
+		}
+		if t.ParentID != nil {
+			if _, err := s.get(ctx, *t.ParentID); err != nil {
+				t.ParentID = nil
+			}
+		}
+		t.userID, _ = UserIDFromContext(ctx)
+		t.Position = s.nextPosition(t.userID)
+		s.todos[t.ID] = t
+		s.nextID++
+		s.record(ctx, auditCreated, t, nil, t.snapshot())
+		return t.snapshot(), nil
+	})
+}
+
+func (s *InMemoryTodoStore) RestoreDeleted(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.todos[id]
+	if !ok || t.DeletedAt == nil || !visible(ctx, t) {
+		return ErrTodoNotFound
+	}
+	before := t.snapshot()
+	t.DeletedAt = nil
+	s.record(ctx, auditRestored, t, before, t.snapshot())
+	return nil
+}
+
+func (s *InMemoryTodoStore) Archive(ctx context.Context, id int) error {
+	return s.setArchived(ctx, id, true)
+}
+
+func (s *InMemoryTodoStore) Unarchive(ctx context.Context, id int) error {
+	return s.setArchived(ctx, id, false)
+}
+
+func (s *InMemoryTodoStore) setArchived(ctx context.Context, id int, archived bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	before := t.snapshot()
+	t.Archived = archived
+	t.touch(ctx)
+	s.record(ctx, auditUpdated, t, before, t.snapshot())
+	return nil
+}
+
+func (s *InMemoryTodoStore) DeleteCompleted(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	completed := true
+	// Decide on the whole set first, as the single SQL statement does.
+	var doomed []*memTodo
+	for _, t := range s.filter(ctx, TodoFilter{Completed: &completed}) {
+		if !s.hasChildren(t.ID, false) {
+			doomed = append(doomed, t)
+		}
+	}
+	now := memNow()
+	for _, t := range doomed {
+		before := t.snapshot()
+		t.DeletedAt = &now
+		s.record(ctx, auditDeleted, t, before, t.snapshot())
+	}
+	return len(doomed), nil
+}
+
+func (s *InMemoryTodoStore) DeleteMany(ctx context.Context, ids []int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var doomed []*memTodo
+	for _, id := range uniqueIDs(ids) {
+		if t, err := s.get(ctx, id); err == nil {
+			doomed = append(doomed, t)
+		}
+	}
+	now := memNow()
+	n := 0
+	// Delete in passes, as the SQL store does, so parents go after their
+	// subtasks.
+	for {
+		var pass []*memTodo
+		for _, t := range doomed {
+			if t.DeletedAt == nil && !s.hasChildren(t.ID, false) {
+				pass = append(pass, t)
+			}
+		}
+		if len(pass) == 0 {
+			return n, nil
+		}
+		for _, t := range pass {
+			before := t.snapshot()
+			t.DeletedAt = &now
+			s.record(ctx, auditDeleted, t, before, t.snapshot())
+		}
+		n += len(pass)
+	}
+}
+
+func (s *InMemoryTodoStore) CompleteAll(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := false
+	todos := s.filter(ctx, TodoFilter{Completed: &pending})
+	for _, t := range todos {
+		before := t.snapshot()
+		t.Completed = true
+		t.touch(ctx)
+		s.record(ctx, auditUpdated, t, before, t.snapshot())
+	}
+	return len(todos), nil
+}
+
+func (s *InMemoryTodoStore) Stats(ctx context.Context) (*TodoStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	var stats TodoStats
+	for _, t := range s.filter(ctx, TodoFilter{}) {
+		stats.Total++
+		if t.Completed {
+			stats.Completed++
+		} else if t.DueDate != nil && t.DueDate.Before(now) {
+			stats.Overdue++
+		}
+		if !t.CreatedAt.Before(today) {
+			stats.CreatedToday++
+		}
+	}
+	stats.Pending = stats.Total - stats.Completed
+	return &stats, nil
+}
+
+func (s *InMemoryTodoStore) AddTag(ctx context.Context, todoID int, tag string) error {
+	tag, err := validateTag(tag)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.get(ctx, todoID)
+	if err != nil {
+		return err
+	}
+	if !contains(t.tags, tag) {
+		before := append([]string{}, t.tags...)
+		t.tags = append(t.tags, tag)
+		sort.Strings(t.tags)
+		t.touch(ctx)
+		s.recordDiff(ctx, auditUpdated, t, tagsDiff(before, t.tags))
+	}
+	return nil
+}
+
+func (s *InMemoryTodoStore) RemoveTag(ctx context.Context, todoID int, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.get(ctx, todoID)
+	if err != nil {
+		return err
+	}
+	tag = normalizeTag(tag)
+	for i, existing := range t.tags {
+		if existing == tag {
+			before := append([]string{}, t.tags...)
+			t.tags = append(t.tags[:i:i], t.tags[i+1:]...)
+			t.touch(ctx)
+			s.recordDiff(ctx, auditUpdated, t, tagsDiff(before, t.tags))
+			break
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryTodoStore) GetTags(ctx context.Context, todoID int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.get(ctx, todoID)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{}, t.tags...), nil
+}
+
+func (s *InMemoryTodoStore) GetChildren(ctx context.Context, parentID int) ([]*Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.get(ctx, parentID); err != nil {
+		return nil, err
+	}
+	children := []*Todo{}
+	for _, t := range s.filter(ctx, TodoFilter{}) {
+		if t.ParentID != nil && *t.ParentID == parentID {
+			children = append(children, t.snapshot())
+		}
+	}
+	return children, nil
+}
+
+// History mirrors TodoSQLStore.History.
+func (s *InMemoryTodoStore) History(ctx context.Context, id int) ([]*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userID, scoped := UserIDFromContext(ctx)
+	entries := []*AuditEntry{}
+	for _, entry := range s.audit {
+		if entry.TodoID == id && (!scoped || entry.owner == userID) {
+			entry := entry.AuditEntry
+			entries = append(entries, &entry)
+		}
+	}
+	if len(entries) == 0 {
+		if t, ok := s.todos[id]; !ok || !visible(ctx, t) {
+			return nil, ErrTodoNotFound
+		}
+	}
+	return entries, nil
+}
+
+// nextPosition returns the position after the last of userID's todos. The
+// caller holds mu.
+func (s *InMemoryTodoStore) nextPosition(userID string) int {
+	last := 0
+	for _, t := range s.todos {
+		if t.userID == userID {
+			last = max(last, t.Position)
+		}
+	}
+	return last + 1
+}
+
+func (s *InMemoryTodoStore) Reorder(ctx context.Context, id, position int) error {
+	if err := validatePosition(position); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	moved, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	var siblings []*memTodo
+	for _, t := range s.todos {
+		if t.userID == moved.userID && t.DeletedAt == nil {
+			siblings = append(siblings, t)
+		}
+	}
+	sort.Slice(siblings, func(i, j int) bool {
+		a, b := siblings[i], siblings[j]
+		return a.Position < b.Position || a.Position == b.Position && a.ID < b.ID
+	})
+	ids := make([]int, len(siblings))
+	for i, t := range siblings {
+		ids[i] = t.ID
+	}
+	before := moved.snapshot()
+	for i, todoID := range moveTo(ids, id, position) {
+		s.todos[todoID].Position = i + 1
+	}
+	moved.touch(ctx)
+	s.record(ctx, auditUpdated, moved, before, moved.snapshot())
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"time"
+)
+
+// mergePatchType is the media type of an RFC 7386 JSON Merge Patch, which is
+// what PATCH /todos/{id} takes. A plain application/json body is read the
+// same way.
+const mergePatchType = "application/merge-patch+json"
+
+// maxMergeAttempts bounds how often a PATCH without If-Match is merged again
+// after another write changed the todo between reading and saving it.
+const maxMergeAttempts = 3
+
+// checkPatchType rejects a PATCH body that isn't a merge patch, such as an
+// RFC 6902 JSON Patch, with 415. On failure it writes the error response and
+// returns false.
+func checkPatchType(w http.ResponseWriter, r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return false
+	}
+	if mediaType != mergePatchType && mediaType != "application/json" {
+		w.Header().Set("Accept-Patch", mergePatchType)
+		writeJSONError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "PATCH takes "+mergePatchType+" or application/json")
+		return false
+	}
+	return true
+}
+
+// mergePatch applies a merge patch to todo and returns the result, leaving
+// todo as it was. Each member of patch replaces the field of that name, null
+// clears a nullable field such as due_date, and fields the patch leaves out
+// keep their value. The names must be keys of patchColumns; every member
+// that isn't, or holds an invalid value, is reported.
+func mergePatch(todo *Todo, patch map[string]interface{}) (*Todo, error) {
+	values, err := convertFields(patch)
+	if err != nil {
+		return nil, err
+	}
+	merged := *todo
+	setFields(&merged, values)
+	return &merged, nil
+}
+
+// setFields stores values, already converted by patchColumns, in the fields
+// of todo they name.
+func setFields(todo *Todo, values map[string]interface{}) {
+	for name, v := range values {
+		switch name {
+		case "title":
+			todo.Title = v.(string)
+		case "completed":
+			todo.Completed = v.(bool)
+		case "due_date":
+			todo.DueDate = nil
+			if due, ok := v.(time.Time); ok {
+				todo.DueDate = &due
+			}
+		case "priority":
+			todo.Priority = v.(string)
+		case "recurrence":
+			todo.Recurrence = v.(string)
+		}
+	}
+}
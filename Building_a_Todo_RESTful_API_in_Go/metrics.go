@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the HTTP instrumentation exported on /metrics.
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+}
+
+func newMetrics(store TodoStore) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "todo_http_requests_total",
+			Help: "HTTP requests served, by method, route and status code.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "todo_http_request_duration_seconds",
+			Help:    "Time spent serving HTTP requests, by method and route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "todo_http_requests_in_flight",
+			Help: "HTTP requests currently being served, by method and route.",
+		}, []string{"method", "route"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.duration,
+		m.inFlight,
+		&todoCountCollector{store: store},
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument records metrics for h under the route of pattern, e.g.
+// "/todos/{id}" for "GET /todos/{id}". Labelling by pattern rather than path
+// keeps the number of series bounded.
+func (m *metrics) instrument(pattern string, h http.Handler) http.Handler {
+	route := pattern
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		route = pattern[i+1:]
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight := m.inFlight.WithLabelValues(r.Method, route)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		m.duration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// todoCountCollector exports the number of todos the default list shows,
+// queried at scrape time.
+type todoCountCollector struct {
+	store TodoStore
+}
+
+var todoCountDesc = prometheus.NewDesc("todo_todos", "Todos currently stored, excluding deleted and archived ones.", nil, nil)
+
+func (c *todoCountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- todoCountDesc
+}
+
+func (c *todoCountCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	n, err := c.store.Count(ctx, TodoFilter{})
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(todoCountDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(todoCountDesc, prometheus.GaugeValue, float64(n))
+}
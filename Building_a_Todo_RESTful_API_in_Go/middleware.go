@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// statusRecorder remembers the status code written through it, and any error
+// passed to recordError, so middleware can report them after the handler
+// returns.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	err    error
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades through; gorilla/websocket asserts
+// http.Hijacker rather than going through http.ResponseController.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// recordError attaches err to the request's log line. Handlers call it for
+// failures that the response alone doesn't explain, such as internal errors.
+func recordError(w http.ResponseWriter, err error) {
+	for {
+		if rec, ok := w.(*statusRecorder); ok {
+			rec.err = err
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// logRequests logs one line per request with its method, path, status code,
+// how long it took to serve and any recorded error. Server errors are logged
+// at error level, everything else at info.
+func logRequests(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rec.status),
+				slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			}
+			level := slog.LevelInfo
+			if rec.status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			if rec.err != nil {
+				attrs = append(attrs, slog.String("error", rec.err.Error()))
+			}
+			logger.LogAttrs(r.Context(), level, "request", attrs...)
+		})
+	}
+}
+
+// recoverPanics turns a panicking handler into a 500 response instead of a
+// dropped connection, logging the panic value and stack trace.
+// http.ErrAbortHandler is re-panicked so deliberate aborts still work.
+func recoverPanics(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logger.ErrorContext(r.Context(), "panic serving request",
+					"panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+				recordError(w, fmt.Errorf("panic: %v", v))
+				writeJSONError(w, http.StatusInternalServerError, "internal_error", internalErrorMessage)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+const (
+	corsAllowMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders = "Authorization, Content-Type, Idempotency-Key, X-API-Key, X-Request-ID"
+)
+
+// cors adds CORS headers for requests from allowedOrigins and answers
+// preflight requests itself. An origin of "*" allows any origin.
+func cors(allowedOrigins []string) func(http.Handler) http.Handler {
+	allowAny := contains(allowedOrigins, "*")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			switch {
+			case allowAny:
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			case origin != "" && contains(allowedOrigins, origin):
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitBody caps request bodies at n bytes. Reading past the limit fails
+// with an *http.MaxBytesError, which decodeJSON reports as 413.
+func limitBody(n int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// streamingPaths hold their connection open on purpose, so withTimeout
+// leaves them alone.
+var streamingPaths = versionedPaths("/todos/events", "/ws")
+
+// withTimeout cancels the request context after d, so store queries that run
+// longer than that are abandoned instead of holding a connection.
+func withTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if contains(streamingPaths, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// publicPaths skip authentication and rate limiting so probes, the metrics
+// scraper and the API docs keep working.
+var publicPaths = []string{"/healthz", "/readyz", "/metrics", "/openapi.json", "/docs"}
+
+// requireAPIKey rejects requests whose X-API-Key header doesn't match one of
+// keys. With no keys configured every request is let through.
+func requireAPIKey(keys []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(keys) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if contains(publicPaths, r.URL.Path) || validAPIKey(keys, r.Header.Get("X-API-Key")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid API key")
+		})
+	}
+}
+
+// validAPIKey compares got against every key in constant time, without
+// stopping at the first match, so timing doesn't reveal which key is close.
+func validAPIKey(keys []string, got string) bool {
+	if got == "" {
+		return false
+	}
+	match := 0
+	for _, key := range keys {
+		match |= subtle.ConstantTimeCompare([]byte(key), []byte(got))
+	}
+	return match == 1
+}
+
+// readOnlyRetryAfter is the Retry-After sent with writes refused in
+// read-only mode. It is only a hint: the server can't know when maintenance
+// ends.
+const readOnlyRetryAfter = 5 * time.Minute
+
+// readOnlyMessage explains the error writes get in read-only mode, over
+// HTTP, the WebSocket and gRPC alike.
+const readOnlyMessage = "the server is in read-only mode for maintenance"
+
+// readOnlyPostPaths are POSTed to without writing, so readOnly lets them
+// through. POST /graphql takes mutations too; those are refused by its
+// resolvers.
+var readOnlyPostPaths = versionedPaths("/todos/search", "/graphql")
+
+// readOnly, when enabled, keeps the server answering GET, HEAD and OPTIONS
+// and the POSTs to readOnlyPostPaths while refusing every other request with
+// 503 and a Retry-After header, so reads keep working during maintenance.
+// Commands over GET /ws are refused by readCommands, GraphQL mutations by
+// graphQLResolver and gRPC calls by grpcReadOnly.
+func readOnly(enabled bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+		retryAfter := strconv.Itoa(int(readOnlyRetryAfter.Seconds()))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			case http.MethodPost:
+				if contains(readOnlyPostPaths, r.URL.Path) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Set("Retry-After", retryAfter)
+			writeJSONError(w, http.StatusServiceUnavailable, "read_only", readOnlyMessage)
+		})
+	}
+}
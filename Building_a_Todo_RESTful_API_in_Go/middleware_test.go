@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := recoverPanics(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/todos", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body errorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding the body: %v", err)
+	}
+	if body.Error.Code != "internal_error" || body.Error.Message != "internal server error" {
+		t.Errorf("error = %+v, want internal_error: internal server error", body.Error)
+	}
+}
+
+func TestRecoverPanicsRepanicsAbort(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := recoverPanics(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", p)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/todos", nil))
+}
+
+func TestReadOnlyRefusesWrites(t *testing.T) {
+	handler := readOnly(true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/todos", nil))
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("%s: status = %d, want it passed through", method, rec.Code)
+		}
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/todos", nil))
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: status = %d, Retry-After %q; want 503 with Retry-After", method, rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+	for _, path := range []string{"/todos/search", "/v1/todos/search", "/graphql"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("POST %s: status = %d, want it passed through", path, rec.Code)
+		}
+	}
+
+	// Inside authentication, as main wraps it, a write without a key gets
+	// 401 rather than 503.
+	rec := httptest.NewRecorder()
+	requireAPIKey([]string{"key"})(handler).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/todos", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST without an API key: status = %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration is one schema change. Migrations are applied in version order,
+// each in its own transaction, and recorded in schema_migrations so they
+// only ever run once. Add new ones at the end of migrations with the next
+// version; never edit or reorder one that has shipped.
+type migration struct {
+	version int
+	name    string
+	up      string
+	// addsColumn names the todos column up adds, if any. Databases created
+	// before migrations were versioned may already have it, in which case
+	// the step is only recorded.
+	addsColumn string
+}
+
+func addTodoColumn(version int, column, definition string) migration {
+	return migration{
+		version:    version,
+		name:       "add todos." + column,
+		up:         "ALTER TABLE todos ADD COLUMN " + column + " " + definition,
+		addsColumn: column,
+	}
+}
+
+// migrations lists the schema's history for db's driver.
+func (db *DB) migrations() []migration {
+	return []migration{
+		{version: 1, name: "create todos", up: `
+  CREATE TABLE IF NOT EXISTS todos (
+   id ` + db.idColumn() + `,
+   title TEXT NOT NULL,
+   completed BOOLEAN NOT NULL DEFAULT false,
+   created_at ` + db.timestampType() + ` NOT NULL DEFAULT CURRENT_TIMESTAMP
+  )`},
+		addTodoColumn(2, "due_date", db.timestampType()),
+		addTodoColumn(3, "priority", "TEXT NOT NULL DEFAULT '"+defaultPriority+"'"),
+		addTodoColumn(4, "deleted_at", db.timestampType()),
+		addTodoColumn(5, "version", "INTEGER NOT NULL DEFAULT 1"),
+		// SQLite can't add a column with a CURRENT_TIMESTAMP default, so
+		// updated_at is nullable, backfilled here and always set on write.
+		addTodoColumn(6, "updated_at", db.timestampType()),
+		{version: 7, name: "backfill todos.updated_at", up: "UPDATE todos SET updated_at = created_at WHERE updated_at IS NULL"},
+		addTodoColumn(8, "user_id", "TEXT"),
+		addTodoColumn(9, "parent_id", "INTEGER REFERENCES todos(id)"),
+		addTodoColumn(10, "recurrence", "TEXT NOT NULL DEFAULT '"+recurrenceNone+"'"),
+		addTodoColumn(11, "archived", "BOOLEAN NOT NULL DEFAULT false"),
+		addTodoColumn(12, "position", "INTEGER NOT NULL DEFAULT 0"),
+		// Existing todos keep their creation order.
+		{version: 13, name: "backfill todos.position", up: "UPDATE todos SET position = id WHERE position = 0"},
+		{version: 14, name: "create tags", up: `
+  CREATE TABLE IF NOT EXISTS tags (
+   id ` + db.idColumn() + `,
+   name TEXT NOT NULL UNIQUE
+  )`},
+		{version: 15, name: "create todo_tags", up: `
+  CREATE TABLE IF NOT EXISTS todo_tags (
+   todo_id INTEGER NOT NULL REFERENCES todos(id) ON DELETE CASCADE,
+   tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+   PRIMARY KEY (todo_id, tag_id)
+  )`},
+		{version: 16, name: "create idempotency_keys", up: `
+  CREATE TABLE IF NOT EXISTS idempotency_keys (
+   owner TEXT NOT NULL,
+   idempotency_key TEXT NOT NULL,
+   todo_id INTEGER NOT NULL REFERENCES todos(id) ON DELETE CASCADE,
+   created_at ` + db.timestampType() + ` NOT NULL DEFAULT CURRENT_TIMESTAMP,
+   PRIMARY KEY (owner, idempotency_key)
+  )`},
+		addTodoColumn(17, "notified_at", db.timestampType()),
+		addTodoColumn(18, "created_by", "TEXT"),
+		addTodoColumn(19, "updated_by", "TEXT"),
+		// Only a todo's owner can change it, so the owner is who created
+		// and last changed the todos that are already there.
+		{version: 20, name: "backfill todos.created_by and updated_by", up: "UPDATE todos SET created_by = user_id, updated_by = user_id WHERE created_by IS NULL"},
+		// No foreign key on todo_id: a todo's history outlives the todo.
+		{version: 21, name: "create audit_log", up: `
+  CREATE TABLE IF NOT EXISTS audit_log (
+   id ` + db.idColumn() + `,
+   todo_id INTEGER NOT NULL,
+   user_id TEXT,
+   actor TEXT,
+   action TEXT NOT NULL,
+   diff TEXT NOT NULL,
+   created_at ` + db.timestampType() + ` NOT NULL DEFAULT CURRENT_TIMESTAMP
+  )`},
+		{version: 22, name: "index audit_log.todo_id", up: "CREATE INDEX IF NOT EXISTS audit_log_todo_id ON audit_log (todo_id)"},
+		addTodoColumn(23, "external_id", "TEXT"),
+		// NULLs don't collide, so only client-supplied IDs are unique. The
+		// index is also what Create's ON CONFLICT (external_id) relies on.
+		{version: 24, name: "unique todos.external_id", up: "CREATE UNIQUE INDEX IF NOT EXISTS todos_external_id ON todos (external_id)"},
+	}
+}
+
+// EnsureMigration brings the schema up to date by applying every migration
+// not yet recorded in schema_migrations. Running it again is a no-op.
+func (db *DB) EnsureMigration() error {
+	if _, err := db.Exec(`
+  CREATE TABLE IF NOT EXISTS schema_migrations (
+   version INTEGER PRIMARY KEY,
+   name TEXT NOT NULL,
+   applied_at ` + db.timestampType() + ` NOT NULL DEFAULT CURRENT_TIMESTAMP
+  );
+ `); err != nil {
+		return err
+	}
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range db.migrations() {
+		if applied[m.version] {
+			continue
+		}
+		if err := db.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	db.migrated.Store(true)
+	return nil
+}
+
+func (db *DB) appliedMigrations() (map[int]bool, error) {
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration runs m and records it in one transaction, so a failed step
+// leaves neither the change nor the record behind.
+func (db *DB) applyMigration(m migration) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	run := true
+	if m.addsColumn != "" {
+		exists, err := db.hasColumn(tx, "todos", m.addsColumn)
+		if err != nil {
+			return err
+		}
+		run = !exists
+	}
+	if run {
+		if _, err := tx.Exec(m.up); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(db.rebind("INSERT INTO schema_migrations (version, name) VALUES (?, ?)"), m.version, m.name)
+	return err
+}
+
+// hasColumn reports whether table already has column.
+func (db *DB) hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	query := "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+	if db.Driver == driverPostgres {
+		query = "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2"
+	}
+	var n int
+	if err := tx.QueryRow(query, table, column).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
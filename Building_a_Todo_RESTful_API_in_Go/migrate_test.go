@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// migrationState reports the latest version in schema_migrations, how many
+// rows it has and how many distinct versions those rows hold.
+func migrationState(t *testing.T, db *DB) (latest, rows, versions int) {
+	t.Helper()
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0), COUNT(*), COUNT(DISTINCT version) FROM schema_migrations").Scan(&latest, &rows, &versions)
+	if err != nil {
+		t.Fatalf("reading schema_migrations: %v", err)
+	}
+	return latest, rows, versions
+}
+
+func TestEnsureMigrationTwice(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "todos.db"), DBOptions{})
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+	all := db.migrations()
+	want := all[len(all)-1].version
+
+	if err := db.EnsureMigration(); err != nil {
+		t.Fatalf("first EnsureMigration: %v", err)
+	}
+	latest, rows, versions := migrationState(t, db)
+	if latest != want || rows != len(all) || versions != rows {
+		t.Fatalf("after the first run: latest %d, %d rows, %d versions; want %d, %d, %d", latest, rows, versions, want, len(all), len(all))
+	}
+
+	if err := db.EnsureMigration(); err != nil {
+		t.Fatalf("second EnsureMigration: %v", err)
+	}
+	latest2, rows2, versions2 := migrationState(t, db)
+	if latest2 != latest || rows2 != rows || versions2 != versions {
+		t.Fatalf("after the second run: latest %d, %d rows, %d versions; want them unchanged at %d, %d, %d", latest2, rows2, versions2, latest, rows, versions)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responseFormat is a representation the API can answer in.
+type responseFormat struct {
+	contentType string
+	marshal     func(interface{}) ([]byte, error)
+}
+
+var (
+	jsonFormat = responseFormat{"application/json", json.Marshal}
+	xmlFormat  = responseFormat{"application/xml", func(v interface{}) ([]byte, error) {
+		body, err := xml.Marshal(v)
+		return append([]byte(xml.Header), body...), err
+	}}
+)
+
+// negotiate picks the response format from the Accept header: XML when the
+// client prefers application/xml or text/xml over JSON, JSON otherwise.
+func negotiate(r *http.Request) responseFormat {
+	var jsonQ, xmlQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/xml", "text/xml":
+			xmlQ = max(xmlQ, q)
+		case "application/json", "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	if xmlQ > jsonQ {
+		return xmlFormat
+	}
+	return jsonFormat
+}
+
+// writeResponse replies with status and v encoded in the format the client
+// asked for. Like writeJSON, v is marshaled before anything is written.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	format := negotiate(r)
+	body, err := format.marshal(v)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	body = append(body, '\n')
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Add("Vary", "Accept")
+	// net/http only works the length out for short bodies; setting it lets
+	// a HEAD request, whose body is dropped, learn the size of any todo.
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// MarshalJSON encodes a todo without its id if keysOnly is set, and with
+// parentKey as its parent_id.
+func (t Todo) MarshalJSON() ([]byte, error) {
+	type plain Todo
+	if !t.keysOnly {
+		return json.Marshal(plain(t))
+	}
+	t.ID = 0
+	return json.Marshal(struct {
+		plain
+		ParentID *string `json:"parent_id,omitempty"`
+	}{plain(t), t.parentKey})
+}
+
+// MarshalXML encodes a todo as a <todo> element, nesting its children and
+// tags in <children> and <tags> elements that are left out when empty. A
+// "children>todo,omitempty" tag would still emit the empty wrapper element.
+// Like MarshalJSON, it leaves the id out if keysOnly is set and then shows
+// parentKey as parent_id.
+func (t *Todo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain Todo
+	parentID := t.parentKey
+	if t.keysOnly {
+		hidden := *t
+		hidden.ID = 0
+		t = &hidden
+	} else if t.ParentID != nil {
+		id := strconv.Itoa(*t.ParentID)
+		parentID = &id
+	}
+	out := struct {
+		*plain
+		// ParentID hides the embedded one, so it holds the integer id too
+		// when that is shown.
+		ParentID *string `xml:"parent_id,omitempty"`
+		Children *struct {
+			Todos []*Todo `xml:"todo"`
+		} `xml:"children,omitempty"`
+		Tags *struct {
+			Tags []string `xml:"tag"`
+		} `xml:"tags,omitempty"`
+	}{plain: (*plain)(t), ParentID: parentID}
+	if len(t.Children) > 0 {
+		out.Children = &struct {
+			Todos []*Todo `xml:"todo"`
+		}{t.Children}
+	}
+	if len(t.Tags) > 0 {
+		out.Tags = &struct {
+			Tags []string `xml:"tag"`
+		}{t.Tags}
+	}
+	start.Name.Local = "todo"
+	return e.EncodeElement(out, start)
+}
+
+// todoList is a list of todos that encodes as a JSON array or as a <todos>
+// element holding one <todo> per entry.
+type todoList []*Todo
+
+func (l todoList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name.Local = "todos"
+	return e.EncodeElement(struct {
+		Todos []*Todo `xml:"todo"`
+	}{l}, start)
+}
+
+// todoPage is a list response with its paging in the body rather than in
+// headers, as GET /todos returns it with ?envelope=true. In XML the todos
+// keep their <todos> element.
+type todoPage struct {
+	XMLName xml.Name `json:"-" xml:"todo_page"`
+	// Data is a todoList or a sparseTodos.
+	Data interface{} `json:"data"`
+	Page pageInfo    `json:"page" xml:"page"`
+}
+
+type pageInfo struct {
+	Limit  int `json:"limit" xml:"limit"`
+	Offset int `json:"offset" xml:"offset"`
+	Total  int `json:"total" xml:"total"`
+}
+
+// sparseTodo encodes only the given todoFields of a todo, in that order in
+// XML. A field asked for but unset, like a missing due_date, is null in JSON
+// and left out of XML. If the todo has keysOnly set, the id is left out and
+// parent_id is its parentKey.
+type sparseTodo struct {
+	todo   *Todo
+	fields []string
+}
+
+// shows reports whether field is encoded.
+func (s sparseTodo) shows(field string) bool {
+	return field != "id" || !s.todo.keysOnly
+}
+
+// value returns the value field is encoded with.
+func (s sparseTodo) value(field string) interface{} {
+	if field == "parent_id" && s.todo.keysOnly {
+		return s.todo.parentKey
+	}
+	return todoFields[field](s.todo)
+}
+
+func (s sparseTodo) MarshalJSON() ([]byte, error) {
+	out := make(map[string]interface{}, len(s.fields))
+	for _, field := range s.fields {
+		if s.shows(field) {
+			out[field] = s.value(field)
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (s sparseTodo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name.Local = "todo"
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, field := range s.fields {
+		if !s.shows(field) {
+			continue
+		}
+		if err := e.EncodeElement(s.value(field), xml.StartElement{Name: xml.Name{Local: field}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// sparseTodos is a todoList of sparseTodo.
+type sparseTodos []sparseTodo
+
+func sparseList(todos []*Todo, fields []string) sparseTodos {
+	out := make(sparseTodos, len(todos))
+	for i, todo := range todos {
+		out[i] = sparseTodo{todo, fields}
+	}
+	return out
+}
+
+func (l sparseTodos) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name.Local = "todos"
+	return e.EncodeElement(struct {
+		Todos []sparseTodo `xml:"todo"`
+	}{l}, start)
+}
+
+// writeTodos replies with a list of todos in the negotiated format.
+func writeTodos(w http.ResponseWriter, r *http.Request, status int, todos []*Todo) {
+	writeResponse(w, r, status, todoList(todos))
+}
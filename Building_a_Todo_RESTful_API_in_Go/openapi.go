@@ -0,0 +1,410 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The types below cover the part of OpenAPI 3.0 this API needs. The document
+// is built in Go rather than kept as a separate file so it is checked by the
+// compiler and changes alongside the handlers.
+
+type openAPIDoc struct {
+	OpenAPI    string                     `json:"openapi"`
+	Info       openAPIInfo                `json:"info"`
+	Servers    []openAPIServer            `json:"servers,omitempty"`
+	Paths      map[string]openAPIPathItem `json:"paths"`
+	Components openAPIComponents          `json:"components"`
+	Security   []map[string][]string      `json:"security,omitempty"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+// openAPIPathItem maps a lower-case HTTP method to its operation.
+type openAPIPathItem map[string]*openAPIOperation
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	OperationID string                     `json:"operationId"`
+	Description string                     `json:"description,omitempty"`
+	Parameters  []*openAPIParameter        `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Headers     map[string]openAPIHeader    `json:"headers,omitempty"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIHeader struct {
+	Description string         `json:"description"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref         string                    `json:"$ref,omitempty"`
+	Type        string                    `json:"type,omitempty"`
+	Format      string                    `json:"format,omitempty"`
+	Description string                    `json:"description,omitempty"`
+	Enum        []string                  `json:"enum,omitempty"`
+	Default     interface{}               `json:"default,omitempty"`
+	Minimum     *int                      `json:"minimum,omitempty"`
+	Maximum     *int                      `json:"maximum,omitempty"`
+	MaxLength   int                       `json:"maxLength,omitempty"`
+	Nullable    bool                      `json:"nullable,omitempty"`
+	ReadOnly    bool                      `json:"readOnly,omitempty"`
+	Items       *openAPISchema            `json:"items,omitempty"`
+	OneOf       []*openAPISchema          `json:"oneOf,omitempty"`
+	Properties  map[string]*openAPISchema `json:"properties,omitempty"`
+	Required    []string                  `json:"required,omitempty"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema         `json:"schemas"`
+	SecuritySchemes map[string]*openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+	In     string `json:"in,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+func schemaRef(name string) *openAPISchema {
+	return &openAPISchema{Ref: "#/components/schemas/" + name}
+}
+
+func jsonContent(schema *openAPISchema) map[string]openAPIMediaType {
+	return map[string]openAPIMediaType{"application/json": {Schema: schema}}
+}
+
+// todoContent is the content of todo responses, which can also be XML.
+func todoContent(schema *openAPISchema) map[string]openAPIMediaType {
+	return map[string]openAPIMediaType{
+		"application/json": {Schema: schema},
+		"application/xml":  {Schema: schema},
+	}
+}
+
+func errorResponse(description string) openAPIResponse {
+	return openAPIResponse{Description: description, Content: jsonContent(schemaRef("Error"))}
+}
+
+func queryParam(name, description string, schema *openAPISchema) *openAPIParameter {
+	return &openAPIParameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+func intPtr(n int) *int {
+	return &n
+}
+
+// openAPISpec describes /todos and /todos/{id}, with the page sizes the
+// server was configured with.
+func openAPISpec(pages PageSizes) *openAPIDoc {
+	pages = pages.withDefaults()
+	idParam := &openAPIParameter{Name: "id", In: "path", Required: true, Description: "The todo's id or external ID; only the external ID under the uuid and ulid ID strategies.", Schema: &openAPISchema{OneOf: []*openAPISchema{{Type: "integer", Minimum: intPtr(1)}, {Type: "string"}}}}
+	etagHeader := map[string]openAPIHeader{"ETag": {Description: "Current version of the todo, for If-Match.", Schema: &openAPISchema{Type: "string"}}}
+	ifMatch := &openAPIParameter{Name: "If-Match", In: "header", Description: "Only apply the change if the todo still has this ETag.", Schema: &openAPISchema{Type: "string"}}
+	ifNoneMatch := &openAPIParameter{Name: "If-None-Match", In: "header", Description: "Reply 304 if the todo still has one of these ETags.", Schema: &openAPISchema{Type: "string"}}
+	strictDue := queryParam("strict_due", "Reject a due_date that is already in the past.", &openAPISchema{Type: "boolean", Default: false})
+	todoResponse := func(description string) openAPIResponse {
+		return openAPIResponse{Description: description, Headers: etagHeader, Content: todoContent(schemaRef("Todo"))}
+	}
+	timestamp := func(description string) *openAPISchema {
+		return &openAPISchema{Type: "string", Format: "date-time", Description: description}
+	}
+
+	return &openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "Todo API", Version: "1.0.0"},
+		Paths: map[string]openAPIPathItem{
+			"/todos": {
+				"get": {
+					Summary:     "List todos",
+					OperationID: "listTodos",
+					Parameters: []*openAPIParameter{
+						queryParam("ids", fmt.Sprintf("Comma-separated todo ids or external IDs, at most %d, to fetch in that order; missing ones are left out. Only external IDs under the uuid and ulid ID strategies. The other parameters are ignored.", pages.Max), &openAPISchema{Type: "string"}),
+						queryParam("limit", "Page size; larger values are capped to the maximum.", &openAPISchema{Type: "integer", Minimum: intPtr(1), Maximum: intPtr(pages.Max), Default: pages.Default}),
+						queryParam("offset", "Number of todos to skip.", &openAPISchema{Type: "integer", Minimum: intPtr(0)}),
+						queryParam("after", "Return todos with a greater id than the one with this id or external ID, as in the next link; pages in ascending id order.", &openAPISchema{OneOf: []*openAPISchema{{Type: "integer", Minimum: intPtr(0)}, {Type: "string"}}}),
+						queryParam("sort", "Column to sort by.", &openAPISchema{Type: "string", Enum: sortColumns, Default: "position"}),
+						queryParam("order", "Sort direction.", &openAPISchema{Type: "string", Enum: []string{"asc", "desc"}, Default: "asc"}),
+						queryParam("completed", "Only completed or only pending todos.", &openAPISchema{Type: "boolean"}),
+						queryParam("priority", "Only todos with this priority.", &openAPISchema{Type: "string", Enum: priorities}),
+						queryParam("q", "Case-insensitive title search.", &openAPISchema{Type: "string"}),
+						queryParam("tag", "Only todos carrying this tag.", &openAPISchema{Type: "string"}),
+						queryParam("recurring", "Only recurring or only one-off todos.", &openAPISchema{Type: "boolean"}),
+						queryParam("overdue", "Only todos that are, or aren't, overdue: not completed and due before the server's current time. With true and no sort, the most overdue come first.", &openAPISchema{Type: "boolean"}),
+						queryParam("created_after", "Only todos created at or after this RFC3339 time or date.", &openAPISchema{Type: "string"}),
+						queryParam("created_before", "Only todos created before this RFC3339 time or date.", &openAPISchema{Type: "string"}),
+						queryParam("archived", "Return archived todos instead of unarchived ones.", &openAPISchema{Type: "boolean", Default: false}),
+						queryParam("include_deleted", "Also return soft-deleted todos.", &openAPISchema{Type: "boolean"}),
+						queryParam("fields", "Comma-separated fields to return for each todo, e.g. id,title; all by default.", &openAPISchema{Type: "string"}),
+						queryParam("envelope", "Return a TodoPage, with the paging in the body, instead of a bare array.", &openAPISchema{Type: "boolean", Default: false}),
+					},
+					Responses: map[string]openAPIResponse{
+						"200": {
+							Description: "A page of todos: an array, or a TodoPage with envelope=true.",
+							Headers: map[string]openAPIHeader{
+								"X-Total-Count":   {Description: "Number of todos matching the filters.", Schema: &openAPISchema{Type: "integer"}},
+								"Link":            {Description: `With after, the next page as rel="next".`, Schema: &openAPISchema{Type: "string"}},
+								"X-Limit-Clamped": {Description: "The limit used, when the one asked for was above the maximum.", Schema: &openAPISchema{Type: "integer"}},
+							},
+							Content: todoContent(&openAPISchema{OneOf: []*openAPISchema{{Type: "array", Items: schemaRef("Todo")}, schemaRef("TodoPage")}}),
+						},
+						"400": errorResponse("Invalid query parameter."),
+					},
+				},
+				"post": {
+					Summary:     "Create a todo",
+					OperationID: "createTodo",
+					Parameters:  []*openAPIParameter{strictDue},
+					RequestBody: &openAPIRequestBody{Required: true, Content: jsonContent(schemaRef("TodoInput"))},
+					Responses: map[string]openAPIResponse{
+						"201": todoResponse("The created todo."),
+						"400": errorResponse("Malformed body."),
+						"413": errorResponse("Body too large."),
+						"422": errorResponse("Invalid fields, each listed in details."),
+					},
+				},
+			},
+			"/todos/{id}": {
+				"get": {
+					Summary:     "Get a todo",
+					OperationID: "getTodo",
+					Parameters: []*openAPIParameter{
+						idParam,
+						ifNoneMatch,
+						queryParam("include", "Comma-separated extras to embed: tags, children.", &openAPISchema{Type: "string"}),
+					},
+					Responses: map[string]openAPIResponse{
+						"200": todoResponse("The todo."),
+						"304": {Description: "The todo still matches If-None-Match."},
+						"400": errorResponse("The id isn't a positive integer."),
+						"404": errorResponse("No such todo."),
+					},
+				},
+				"head": {
+					Summary:     "Check that a todo exists",
+					OperationID: "headTodo",
+					Parameters:  []*openAPIParameter{idParam, ifNoneMatch},
+					Responses: map[string]openAPIResponse{
+						"200": {Description: "The todo exists; the headers are those GET would send.", Headers: etagHeader},
+						"304": {Description: "The todo still matches If-None-Match."},
+						"400": {Description: "The id isn't a positive integer."},
+						"404": {Description: "No such todo."},
+					},
+				},
+				"put": {
+					Summary:     "Replace a todo",
+					OperationID: "updateTodo",
+					Parameters:  []*openAPIParameter{idParam, ifMatch, strictDue},
+					RequestBody: &openAPIRequestBody{Required: true, Content: jsonContent(schemaRef("TodoInput"))},
+					Responses: map[string]openAPIResponse{
+						"200": todoResponse("The updated todo."),
+						"400": errorResponse("Invalid id or malformed body."),
+						"404": errorResponse("No such todo."),
+						"409": errorResponse("The given version is out of date."),
+						"412": errorResponse("The todo no longer matches If-Match."),
+						"422": errorResponse("Invalid fields, each listed in details."),
+					},
+				},
+				"patch": {
+					Summary:     "Update some fields of a todo",
+					OperationID: "patchTodo",
+					Description: "The body is a JSON Merge Patch (RFC 7386), merged into the current todo: fields it leaves out are kept and null clears due_date.",
+					Parameters:  []*openAPIParameter{idParam, ifMatch, strictDue},
+					RequestBody: &openAPIRequestBody{Required: true, Content: map[string]openAPIMediaType{
+						mergePatchType:     {Schema: schemaRef("TodoPatch")},
+						"application/json": {Schema: schemaRef("TodoPatch")},
+					}},
+					Responses: map[string]openAPIResponse{
+						"200": todoResponse("The updated todo."),
+						"400": errorResponse("Invalid id or malformed body."),
+						"404": errorResponse("No such todo."),
+						"409": errorResponse("The todo kept changing while the patch was merged."),
+						"412": errorResponse("The todo no longer matches If-Match."),
+						"415": errorResponse("The body isn't a merge patch."),
+						"422": errorResponse("Invalid fields, each listed in details."),
+					},
+				},
+				"delete": {
+					Summary:     "Delete a todo",
+					OperationID: "deleteTodo",
+					Parameters: []*openAPIParameter{
+						idParam,
+						queryParam("permanent", "Remove the todo for good instead of soft-deleting it.", &openAPISchema{Type: "boolean"}),
+					},
+					Responses: map[string]openAPIResponse{
+						"200": {Description: "The todo was deleted."},
+						"400": errorResponse("The id isn't a positive integer."),
+						"404": errorResponse("No such todo."),
+						"409": errorResponse("The todo still has subtasks."),
+					},
+				},
+			},
+		},
+		Components: openAPIComponents{
+			Schemas: map[string]*openAPISchema{
+				"Todo": {
+					Type:     "object",
+					Required: []string{"title", "completed", "created_at", "updated_at", "priority", "recurrence", "archived", "position", "version"},
+					Properties: map[string]*openAPISchema{
+						"id":          {Type: "integer", ReadOnly: true, Description: "Left out under the uuid and ulid ID strategies."},
+						"title":       {Type: "string", MaxLength: maxTitleLength},
+						"completed":   {Type: "boolean"},
+						"created_at":  timestamp(""),
+						"updated_at":  timestamp(""),
+						"due_date":    timestamp(""),
+						"priority":    {Type: "string", Enum: priorities},
+						"recurrence":  {Type: "string", Enum: recurrences},
+						"deleted_at":  timestamp("Set on soft-deleted todos."),
+						"archived":    {Type: "boolean", ReadOnly: true, Description: "Changed with POST /todos/{id}/archive and /unarchive."},
+						"position":    {Type: "integer", ReadOnly: true, Description: "Manual sort order, changed with PUT /todos/{id}/position."},
+						"parent_id":   {OneOf: []*openAPISchema{{Type: "integer"}, {Type: "string"}}, Description: "The todo this one is a subtask of: its id, or its external ID under the uuid and ulid ID strategies."},
+						"external_id": {Type: "string", Description: "The UUID or ULID the todo was created with, chosen by the client or generated under the uuid and ulid ID strategies. Where one is set, /todos/{id} takes it in place of the id."},
+						"children":    {Type: "array", Items: schemaRef("Todo"), Description: "Only with include=children."},
+						"tags":        {Type: "array", Items: &openAPISchema{Type: "string"}, Description: "Only with include=tags."},
+						"version":     {Type: "integer", Description: "Bumped on every change."},
+						"created_by":  {Type: "string", Nullable: true, ReadOnly: true, Description: "The user who created the todo; null without authentication."},
+						"updated_by":  {Type: "string", Nullable: true, ReadOnly: true, Description: "The user who last changed the todo; null without authentication."},
+					},
+				},
+				"TodoPage": {
+					Type:     "object",
+					Required: []string{"data", "page"},
+					Properties: map[string]*openAPISchema{
+						"data": {Type: "array", Items: schemaRef("Todo")},
+						"page": {
+							Type:     "object",
+							Required: []string{"limit", "offset", "total"},
+							Properties: map[string]*openAPISchema{
+								"limit":  {Type: "integer"},
+								"offset": {Type: "integer"},
+								"total":  {Type: "integer", Description: "Number of todos matching the filters."},
+							},
+						},
+					},
+				},
+				"TodoInput": {
+					Type:     "object",
+					Required: []string{"title"},
+					Properties: map[string]*openAPISchema{
+						"title":       {Type: "string", MaxLength: maxTitleLength},
+						"completed":   {Type: "boolean"},
+						"due_date":    timestamp(""),
+						"priority":    {Type: "string", Enum: priorities, Default: defaultPriority},
+						"recurrence":  {Type: "string", Enum: recurrences, Default: recurrenceNone},
+						"parent_id":   {OneOf: []*openAPISchema{{Type: "integer"}, {Type: "string"}}, Description: "The parent's id or external ID, only honoured on create. The uuid and ulid ID strategies only take the external ID."},
+						"external_id": {Type: "string", Description: "A UUID or ULID, only honoured on create. If the user already has a todo with it, that todo is returned instead of creating another, so the request can be retried safely."},
+						"version":     {Type: "integer", Description: "On PUT, fail with 409 unless the todo is still at this version."},
+					},
+				},
+				"TodoPatch": {
+					Type: "object",
+					Properties: map[string]*openAPISchema{
+						"title":      {Type: "string", MaxLength: maxTitleLength},
+						"completed":  {Type: "boolean"},
+						"due_date":   {Type: "string", Format: "date-time", Nullable: true},
+						"priority":   {Type: "string", Enum: priorities},
+						"recurrence": {Type: "string", Enum: recurrences},
+					},
+				},
+				"Error": {
+					Type:     "object",
+					Required: []string{"error"},
+					Properties: map[string]*openAPISchema{
+						"error": {
+							Type:     "object",
+							Required: []string{"code", "message"},
+							Properties: map[string]*openAPISchema{
+								"code":    {Type: "string"},
+								"message": {Type: "string"},
+								"details": {
+									Type:        "array",
+									Description: "Each invalid field, when a body fails its schema.",
+									Items: &openAPISchema{
+										Type: "object",
+										Properties: map[string]*openAPISchema{
+											"field":   {Type: "string"},
+											"message": {Type: "string"},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			SecuritySchemes: map[string]*openAPISecurityScheme{
+				"apiKey":     {Type: "apiKey", In: "header", Name: "X-API-Key"},
+				"bearerAuth": {Type: "http", Scheme: "bearer"},
+			},
+		},
+		Security: []map[string][]string{{"apiKey": {}}, {"bearerAuth": {}}},
+	}
+}
+
+func serveOpenAPI(pages PageSizes) http.HandlerFunc {
+	spec := openAPISpec(pages)
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Behind a base path the paths are relative to it, which OpenAPI
+		// says through servers.
+		if prefix := BasePathFromContext(r.Context()); prefix != "" {
+			mounted := *spec
+			mounted.Servers = []openAPIServer{{URL: prefix}}
+			writeJSON(w, http.StatusOK, &mounted)
+			return
+		}
+		writeJSON(w, http.StatusOK, spec)
+	}
+}
+
+// swaggerUIPage renders the spec with Swagger UI loaded from a CDN. The spec
+// URL is relative so the page works under a base path too.
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Todo API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+func serveDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// nextPositionQuery is the subquery giving a new todo the position after the
+// last of its owner's todos. It takes the owner's user ID, or nil, as its
+// argument; COALESCE lets the todos without an owner compare equal.
+const nextPositionQuery = "(SELECT COALESCE(MAX(position), 0) + 1 FROM todos WHERE COALESCE(user_id, '') = COALESCE(?, ''))"
+
+func validatePosition(position int) error {
+	if position < 1 {
+		return &ValidationError{Field: "position", Message: "must be at least 1"}
+	}
+	return nil
+}
+
+// moveTo returns ids with id moved to the 1-based position, clamped to the
+// end of the list.
+func moveTo(ids []int, id, position int) []int {
+	moved := make([]int, 0, len(ids))
+	for _, other := range ids {
+		if other != id {
+			moved = append(moved, other)
+		}
+	}
+	i := min(position-1, len(moved))
+	moved = append(moved[:i], append([]int{id}, moved[i:]...)...)
+	return moved
+}
+
+// Reorder moves a todo to position among its owner's live todos, shifting
+// the others to make room. The owner's positions are renumbered 1..n in the
+// process, so gaps and ties left by deletes or concurrent creates disappear.
+// Only the moved todo counts as changed; the others just get new positions.
+func (store *TodoSQLStore) Reorder(ctx context.Context, id, position int) error {
+	if err := validatePosition(position); err != nil {
+		return err
+	}
+	match, args := todoMatch(ctx, id)
+	return store.audited(ctx, id, auditUpdated, func(tx *TodoSQLStore) error {
+		var owner *string
+		if err := tx.conn().QueryRowContext(ctx, "SELECT user_id FROM todos WHERE "+match+" AND deleted_at IS NULL", args...).Scan(&owner); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrTodoNotFound
+			}
+			return err
+		}
+
+		rows, err := tx.conn().QueryContext(ctx, "SELECT id, position FROM todos WHERE COALESCE(user_id, '') = COALESCE(?, '') AND deleted_at IS NULL ORDER BY position, id", owner)
+		if err != nil {
+			return err
+		}
+		var ids []int
+		current := make(map[int]int)
+		for rows.Next() {
+			var todoID, pos int
+			if err := rows.Scan(&todoID, &pos); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, todoID)
+			current[todoID] = pos
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i, todoID := range moveTo(ids, id, position) {
+			query, args := "UPDATE todos SET position = ? WHERE id = ?", []interface{}{i + 1, todoID}
+			if todoID == id {
+				query = "UPDATE todos SET position = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP, updated_by = ? WHERE id = ?"
+				args = []interface{}{i + 1, actorID(ctx), todoID}
+			} else if current[todoID] == i+1 {
+				continue
+			}
+			if _, err := tx.conn().ExecContext(ctx, query, args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func reorderTodo(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		var input struct {
+			Position int `json:"position"`
+		}
+		if !decodeJSON(w, r, &input) {
+			return
+		}
+		err := store.Reorder(r.Context(), id, input.Position)
+		if IsValidationError(err) {
+			writeValidationError(w, err)
+			return
+		}
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		todo, err := store.GetByID(r.Context(), id)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeTodo(w, r, http.StatusOK, todo)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrQuotaExceeded is returned by Create when the user already has as many
+// todos as their quota allows.
+var ErrQuotaExceeded = errors.New("todo quota reached")
+
+// TodoQuota caps how many todos each user may have. Without authentication
+// all todos belong to the same user, so it caps the whole list. Only
+// creating todos is refused: restores, undos and recurring todos that spawn
+// their next occurrence go ahead even over the limit.
+type TodoQuota struct {
+	// Max is the most todos a user may have; zero means no limit.
+	Max int
+	// CountDone counts completed and archived todos against Max as well.
+	// By default only pending, unarchived todos count, so finishing a todo
+	// makes room for another.
+	CountDone bool
+}
+
+func (q TodoQuota) exceeded() error {
+	what := "active"
+	if q.CountDone {
+		what = "undeleted"
+	}
+	return fmt.Errorf("%w: at most %d %s todos are allowed per user", ErrQuotaExceeded, q.Max, what)
+}
+
+// counts reports whether t counts against the quota.
+func (q TodoQuota) counts(t *Todo) bool {
+	return t.DeletedAt == nil && (q.CountDone || (!t.Completed && !t.Archived))
+}
+
+// checkQuota returns ErrQuotaExceeded if the user in ctx has no room for
+// another todo. It must run in the transaction that inserts the todo.
+func (store *TodoSQLStore) checkQuota(ctx context.Context) error {
+	if store.Quota.Max <= 0 {
+		return nil
+	}
+	query := "SELECT COUNT(*) FROM todos WHERE deleted_at IS NULL"
+	var args []interface{}
+	userID, ok := UserIDFromContext(ctx)
+	if ok {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	if !store.Quota.CountDone {
+		query += " AND completed = ? AND archived = ?"
+		args = append(args, false, false)
+	}
+	if store.DB.Driver == driverPostgres {
+		// Under READ COMMITTED two creates could both count one below the
+		// limit and both insert; SQLite has a single writer anyway.
+		if _, err := store.conn().ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext(?))", "todo-quota:"+userID); err != nil {
+			return err
+		}
+	}
+	var n int
+	if err := store.conn().QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		return err
+	}
+	if n >= store.Quota.Max {
+		return store.Quota.exceeded()
+	}
+	return nil
+}
+
+// checkQuota is the InMemoryTodoStore version. The caller holds mu.
+func (s *InMemoryTodoStore) checkQuota(ctx context.Context) error {
+	if s.Quota.Max <= 0 {
+		return nil
+	}
+	n := 0
+	for _, t := range s.todos {
+		if visible(ctx, t) && s.Quota.counts(&t.Todo) {
+			n++
+		}
+	}
+	if n >= s.Quota.Max {
+		return s.Quota.exceeded()
+	}
+	return nil
+}
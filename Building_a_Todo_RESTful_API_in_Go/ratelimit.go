@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// limiterIdleTTL is how long a client's limiter is kept after its last
+	// request before it is dropped.
+	limiterIdleTTL = 3 * time.Minute
+	// limiterSweepInterval is how often idle limiters are looked for.
+	limiterSweepInterval = time.Minute
+)
+
+// rateLimiter hands out a token bucket per client IP.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		clients: make(map[string]*clientLimiter),
+	}
+}
+
+func (rl *rateLimiter) get(key string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[key] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter
+}
+
+// sweep drops limiters that haven't been used for limiterIdleTTL, so the map
+// doesn't grow with every client ever seen.
+func (rl *rateLimiter) sweep() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cutoff := time.Now().Add(-limiterIdleTTL)
+	for key, c := range rl.clients {
+		if c.lastSeen.Before(cutoff) {
+			delete(rl.clients, key)
+		}
+	}
+}
+
+// run sweeps idle limiters until ctx is cancelled.
+func (rl *rateLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(limiterSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rl.sweep()
+		}
+	}
+}
+
+// Middleware answers 429 with a Retry-After header once a client has used up
+// its burst. Health probes and metrics scrapes are never limited.
+func (rl *rateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contains(publicPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		res := rl.get(clientIP(r)).Reserve()
+		if delay := res.Delay(); delay > 0 {
+			res.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate_limited", "too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP is the address the request came from. X-Forwarded-For is ignored
+// because any client can set it to dodge the limit.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
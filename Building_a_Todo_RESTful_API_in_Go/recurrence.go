@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	recurrenceNone = "none"
+	// recurrenceInterval is how often completed recurring todos are
+	// checked for a next occurrence to create.
+	recurrenceInterval = time.Minute
+)
+
+// recurrenceSteps maps each repeating recurrence to a function that moves a
+// due date on by n occurrences.
+var recurrenceSteps = map[string]func(t time.Time, n int) time.Time{
+	"daily":   func(t time.Time, n int) time.Time { return t.AddDate(0, 0, n) },
+	"weekly":  func(t time.Time, n int) time.Time { return t.AddDate(0, 0, 7*n) },
+	"monthly": addMonths,
+}
+
+// addMonths returns t moved n months on, to the same day of the month or
+// the last day of a shorter month. AddDate would overflow instead: January
+// 31 plus a month is March 3.
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(t.Day(), last)-1)
+}
+
+var recurrences = []string{recurrenceNone, "daily", "weekly", "monthly"}
+
+func validateRecurrence(recurrence string) error {
+	if !contains(recurrences, recurrence) {
+		return &ValidationError{Field: "recurrence", Message: "must be one of " + strings.Join(recurrences, ", ")}
+	}
+	return nil
+}
+
+// nextOccurrence returns the due date of the occurrence following one due
+// at due, or now if it had no due date. Occurrences are skipped until the
+// result is after now, so a chore completed late doesn't come back already
+// overdue. Each is counted from due, so skipping past a short month doesn't
+// move a monthly todo off the 31st. ok is false if recurrence doesn't repeat.
+func nextOccurrence(due *time.Time, recurrence string, now time.Time) (next time.Time, ok bool) {
+	step, ok := recurrenceSteps[recurrence]
+	if !ok {
+		return time.Time{}, false
+	}
+	start := now
+	if due != nil {
+		start = *due
+	}
+	for n := 1; ; n++ {
+		if next = step(start, n); next.After(now) {
+			return next, true
+		}
+	}
+}
+
+// SpawnRecurring creates the next occurrence of every completed recurring
+// todo, copying its title, priority, owner and tags. The recurrence moves to
+// the new todo, so each completion only spawns once. It returns how many
+// todos were created.
+func (store *TodoSQLStore) SpawnRecurring(ctx context.Context) (int, error) {
+	type occurrence struct {
+		id         int
+		title      string
+		dueDate    *time.Time
+		priority   string
+		recurrence string
+		userID     *string
+	}
+	var spawned int
+	err := store.WithTx(ctx, func(tx *TodoSQLStore) error {
+		rows, err := tx.conn().QueryContext(ctx, "SELECT id, title, due_date, priority, recurrence, user_id FROM todos WHERE completed = ? AND recurrence <> ? AND deleted_at IS NULL", true, recurrenceNone)
+		if err != nil {
+			return err
+		}
+		var due []occurrence
+		for rows.Next() {
+			var o occurrence
+			if err := rows.Scan(&o.id, &o.title, &o.dueDate, &o.priority, &o.recurrence, &o.userID); err != nil {
+				rows.Close()
+				return err
+			}
+			due = append(due, o)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		for _, o := range due {
+			next, ok := nextOccurrence(o.dueDate, o.recurrence, now)
+			if !ok {
+				continue
+			}
+			res, err := tx.conn().ExecContext(ctx, "UPDATE todos SET recurrence = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND recurrence <> ?", recurrenceNone, o.id, recurrenceNone)
+			if err != nil {
+				return err
+			}
+			if IsNotFound(checkAffected(res)) {
+				continue
+			}
+			stopped := map[string]fieldChange{"recurrence": {From: o.recurrence, To: recurrenceNone}}
+			if err := tx.recordAudit(ctx, o.id, o.userID, auditUpdated, stopped); err != nil {
+				return err
+			}
+			var id int
+			row := tx.conn().QueryRowContext(ctx, "INSERT INTO todos (title, due_date, priority, recurrence, user_id, external_id, position, updated_at) VALUES (?, ?, ?, ?, ?, ?, "+nextPositionQuery+", CURRENT_TIMESTAMP) RETURNING id", o.title, next, o.priority, o.recurrence, o.userID, newExternalID(tx.IDStrategy), o.userID)
+			if err := row.Scan(&id); err != nil {
+				return err
+			}
+			if _, err := tx.conn().ExecContext(ctx, "INSERT INTO todo_tags (todo_id, tag_id) SELECT ?, tag_id FROM todo_tags WHERE todo_id = ?", id, o.id); err != nil {
+				return err
+			}
+			created, err := tx.getAny(ctx, id)
+			if err != nil {
+				return err
+			}
+			if err := tx.recordAudit(ctx, id, o.userID, auditCreated, todoDiff(nil, created)); err != nil {
+				return err
+			}
+			spawned++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return spawned, nil
+}
+
+// recurrenceSpawner is a store runRecurrence can drive.
+type recurrenceSpawner interface {
+	SpawnRecurring(context.Context) (int, error)
+}
+
+// runRecurrence calls SpawnRecurring every interval until ctx is cancelled.
+func runRecurrence(ctx context.Context, store recurrenceSpawner, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := store.SpawnRecurring(ctx)
+			if err != nil {
+				logger.Error("creating recurring todos", "error", err)
+			} else if n > 0 {
+				logger.Info("created recurring todos", "count", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextOccurrence(t *testing.T) {
+	date := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	}
+	dueAt := func(year int, month time.Month, day, hour int) *time.Time {
+		due := date(year, month, day, hour)
+		return &due
+	}
+	for _, c := range []struct {
+		name       string
+		due        *time.Time
+		recurrence string
+		now        time.Time
+		want       time.Time
+	}{
+		{"daily", dueAt(2026, 3, 10, 9), "daily", date(2026, 3, 10, 12), date(2026, 3, 11, 9)},
+		{"weekly", dueAt(2026, 3, 9, 9), "weekly", date(2026, 3, 10, 12), date(2026, 3, 16, 9)},
+		{"monthly", dueAt(2026, 3, 5, 9), "monthly", date(2026, 3, 10, 12), date(2026, 4, 5, 9)},
+		{"monthly across a year", dueAt(2026, 12, 15, 9), "monthly", date(2026, 12, 15, 12), date(2027, 1, 15, 9)},
+		{"month end", dueAt(2026, 1, 31, 9), "monthly", date(2026, 1, 31, 12), date(2026, 2, 28, 9)},
+		{"month end in a leap year", dueAt(2028, 1, 31, 9), "monthly", date(2028, 1, 31, 12), date(2028, 2, 29, 9)},
+		{"month end into a 30-day month", dueAt(2026, 3, 31, 9), "monthly", date(2026, 3, 31, 12), date(2026, 4, 30, 9)},
+		{"no due date", nil, "weekly", date(2026, 3, 10, 12), date(2026, 3, 17, 12)},
+		{"completed late", dueAt(2026, 3, 1, 9), "daily", date(2026, 3, 10, 12), date(2026, 3, 11, 9)},
+		{"completed late weekly", dueAt(2026, 2, 2, 9), "weekly", date(2026, 3, 10, 12), date(2026, 3, 16, 9)},
+		{"completed late past a short month", dueAt(2026, 1, 31, 9), "monthly", date(2026, 3, 10, 12), date(2026, 3, 31, 9)},
+	} {
+		got, ok := nextOccurrence(c.due, c.recurrence, c.now)
+		if !ok || !got.Equal(c.want) {
+			t.Errorf("%s: nextOccurrence = %v, %v; want %v", c.name, got, ok, c.want)
+		}
+	}
+	if _, ok := nextOccurrence(nil, recurrenceNone, time.Now()); ok {
+		t.Error("nextOccurrence with no recurrence: ok = true, want false")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Notifier delivers a reminder that todo is overdue. The context carries the
+// owner's user ID, if the todo has one.
+type Notifier interface {
+	Notify(ctx context.Context, todo *Todo) error
+}
+
+// LogNotifier writes reminders to a logger. It is the default when no
+// webhook is configured.
+type LogNotifier struct {
+	Logger *slog.Logger
+}
+
+func (n LogNotifier) Notify(ctx context.Context, todo *Todo) error {
+	n.Logger.InfoContext(ctx, "todo overdue", "id", todo.ID, "title", todo.Title, "due_date", todo.DueDate)
+	return nil
+}
+
+// WebhookNotifier POSTs each reminder as JSON to URL. Any response other
+// than 2xx counts as a failure, and the reminder is retried on the next run.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// webhookTimeout bounds one delivery attempt when no Client is given.
+const webhookTimeout = 10 * time.Second
+
+type webhookPayload struct {
+	Event  string `json:"event"`
+	UserID string `json:"user_id,omitempty"`
+	Todo   *Todo  `json:"todo"`
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, todo *Todo) error {
+	userID, _ := UserIDFromContext(ctx)
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: webhookTimeout}
+	}
+	return postJSON(ctx, client, n.URL, webhookPayload{Event: "todo.overdue", UserID: userID, Todo: todo})
+}
+
+// postJSON POSTs v as JSON to url, treating any response other than 2xx as
+// an error.
+func postJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// NotifyOverdue sends a reminder for every pending todo whose due date has
+// passed and marks it with notified_at. A todo is only reminded about again
+// once its due date is moved past the last reminder and that date passes
+// too. Archived todos are skipped. A failed delivery leaves the todo
+// unmarked so the next run retries it; NotifyOverdue still tries the rest
+// and returns how many were delivered along with the failures.
+func (store *TodoSQLStore) NotifyOverdue(ctx context.Context, n Notifier) (int, error) {
+	type overdue struct {
+		id     int
+		userID *string
+	}
+	now := time.Now().UTC()
+	rows, err := store.conn().QueryContext(ctx, "SELECT id, user_id FROM todos WHERE due_date < ? AND completed = ? AND archived = ? AND deleted_at IS NULL AND (notified_at IS NULL OR notified_at < due_date) ORDER BY due_date", now, false, false)
+	if err != nil {
+		return 0, err
+	}
+	var due []overdue
+	for rows.Next() {
+		var o overdue
+		if err := rows.Scan(&o.id, &o.userID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var sent int
+	var errs []error
+	for _, o := range due {
+		todo, err := store.GetByID(ctx, o.id)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return sent, err
+		}
+		notifyCtx := ctx
+		if o.userID != nil {
+			notifyCtx = WithUserID(ctx, *o.userID)
+		}
+		if err := n.Notify(notifyCtx, todo); err != nil {
+			errs = append(errs, fmt.Errorf("todo %d: %w", o.id, err))
+			continue
+		}
+		if _, err := store.conn().ExecContext(ctx, "UPDATE todos SET notified_at = ? WHERE id = ?", time.Now().UTC(), o.id); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, errors.Join(errs...)
+}
+
+// overdueNotifier is a store runReminders can drive.
+type overdueNotifier interface {
+	NotifyOverdue(context.Context, Notifier) (int, error)
+}
+
+// runReminders calls NotifyOverdue every interval until ctx is cancelled.
+func runReminders(ctx context.Context, store overdueNotifier, n Notifier, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sent, err := store.NotifyOverdue(ctx, n)
+			if err != nil && ctx.Err() == nil {
+				logger.Error("sending reminders", "error", err)
+			}
+			if sent > 0 {
+				logger.Info("sent reminders", "count", sent)
+			}
+		}
+	}
+}
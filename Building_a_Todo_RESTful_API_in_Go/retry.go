@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Queries that fail because SQLite is busy are tried up to dbMaxAttempts
+// times, waiting dbRetryBase before the first retry and twice as long before
+// each one after it.
+const (
+	dbMaxAttempts = 5
+	dbRetryBase   = 25 * time.Millisecond
+)
+
+// When the connection to the database is lost, it is pinged until it answers
+// again, waiting dbReconnectBase before the second ping and twice as long
+// before each one after it, up to dbReconnectMax, for at most
+// dbReconnectTimeout.
+const (
+	dbReconnectBase    = 100 * time.Millisecond
+	dbReconnectMax     = 2 * time.Second
+	dbReconnectTimeout = 10 * time.Second
+)
+
+// retryable reports whether err is worth trying again: SQLite found the
+// database or a table locked by another connection. The busy timeout already
+// waits for most locks, but it gives up on some, such as a reader whose
+// snapshot went stale while a writer checkpointed.
+func retryable(err error) bool {
+	var serr sqlite3.Error
+	if errors.As(err, &serr) {
+		return serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// connLost reports whether err means the database couldn't be reached, so
+// the query never ran: dialling it failed, database/sql ran out of pooled
+// connections that still worked, or Postgres is restarting or dropped the
+// connection before taking the query. A connection that breaks while a
+// statement is running isn't counted, since the statement may have run.
+func connLost(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "57P01", "57P02", "57P03": // admin_shutdown, crash_shutdown, cannot_connect_now
+			return true
+		}
+		return pqErr.Code.Class() == "08" // connection_exception
+	}
+	return false
+}
+
+// withRetry runs op until it succeeds, fails with an error that isn't
+// retryable, or has been tried dbMaxAttempts times. When op fails because
+// the connection to the database was lost, it waits for db to come back with
+// reconnect and runs op again; if the database is still away, it gives up.
+// It stops early, returning the last error, if ctx is done or its deadline
+// would pass during the next wait.
+func (db *DB) withRetry(ctx context.Context, op func() error) error {
+	wait := dbRetryBase
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt == dbMaxAttempts {
+			return err
+		}
+		switch {
+		case connLost(err):
+			if db.reconnect(ctx, err) != nil {
+				return err
+			}
+		case retryable(err):
+			if !sleep(ctx, wait) {
+				return err
+			}
+			wait *= 2
+		default:
+			return err
+		}
+	}
+}
+
+// reconnect pings db until it answers, after a query failed with cause
+// because the connection was lost. database/sql opens new connections by
+// itself, so all there is to do is wait for the database to be reachable.
+// While any request is waiting, Reconnecting reports true. reconnect returns
+// nil once a ping succeeds, or the last ping's error when it gives up.
+func (db *DB) reconnect(ctx context.Context, cause error) error {
+	first := db.reconnecting.Add(1) == 1
+	defer db.reconnecting.Add(-1)
+	if first {
+		slog.WarnContext(ctx, "database connection lost, reconnecting", "error", cause)
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, dbReconnectTimeout)
+	defer cancel()
+	wait := dbReconnectBase
+	for {
+		err := db.PingContext(ctx)
+		if err == nil {
+			if first {
+				slog.InfoContext(ctx, "database reconnected", "after", time.Since(start))
+			}
+			return nil
+		}
+		if !connLost(err) || !sleep(ctx, wait) {
+			return err
+		}
+		wait = min(wait*2, dbReconnectMax)
+	}
+}
+
+// Reconnecting reports whether a request is waiting for the database to come
+// back after losing its connection.
+func (db *DB) Reconnecting() bool {
+	return db.reconnecting.Load() > 0
+}
+
+// sleep waits for d and reports true, or reports false straight away if ctx
+// is done or its deadline would pass first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewRouter builds the API's routes on a mux of its own, backed by store.
+// db serves the health and readiness checks; with a nil db, e.g. for an
+// InMemoryTodoStore, they are left out. Changes made through the router are
+// published on events, and opts holds what the handlers are configured with.
+// Each call has its own metrics registry, so routers don't share any global
+// state. Every GET route answers HEAD as well, with the same status and
+// headers and no body. Under the idUUID and idULID strategies todos are
+// read through a keysOnlyStore, so no route shows their integer ids.
+//
+// The todo API is mounted once per entry in apiVersions, under /v1 and so
+// on, and once more at the root for clients from before versioning. The
+// operational endpoints aren't versioned.
+func NewRouter(store TodoStore, db *DB, events *broker, opts RouterOptions) http.Handler {
+	mux := http.NewServeMux()
+	m := newMetrics(store)
+	keysOnly := isKeysOnly(opts.IDStrategy)
+	if keysOnly {
+		store = keysOnlyStore{store}
+	}
+	store = &publishingStore{TodoStore: store, broker: events, keysOnly: keysOnly}
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, m.instrument(pattern, h))
+	}
+
+	if db != nil {
+		handle("GET /healthz", healthz(db))
+		handle("GET /readyz", readyz(db))
+		handle("GET /admin/backup", downloadBackup(db))
+		handle("POST /admin/maintenance", runMaintenance(db))
+	}
+	handle("GET /admin/todos", resolveAfter(store, keysOnly, listAllTodos(store, opts.Pages)))
+	for _, v := range apiVersions {
+		for _, rt := range v.routes(store, events, opts) {
+			h := rt.handler
+			if strings.Contains(rt.pattern, "{id}") {
+				h = resolveKeys(store, keysOnly, h)
+			}
+			handle(rt.under("/"+v.name), h)
+			if v.name == rootVersion {
+				handle(rt.pattern, h)
+			}
+		}
+	}
+	handle("GET /openapi.json", serveOpenAPI(opts.Pages))
+	handle("GET /docs", serveDocs)
+	mux.Handle("GET /metrics", m.Handler())
+	return mux
+}
+
+// RouterOptions configures the handlers NewRouter builds.
+type RouterOptions struct {
+	// Pages bounds how many todos one list or search returns.
+	Pages PageSizes
+	// Timezone is where the day GET /todos/today covers begins and ends,
+	// for requests that don't name one; nil means UTC.
+	Timezone *time.Location
+	// IDStrategy is one of idStrategies. Wherever a todo is named, by an
+	// {id}, the ids and after parameters, a bulk delete, GraphQL or a GET
+	// /ws command, its external ID is taken as well as its integer id, and
+	// only the external ID under idUUID and idULID.
+	IDStrategy string
+	// ReadOnly refuses the commands sent over GET /ws and GraphQL
+	// mutations; the readOnly middleware refuses the HTTP writes.
+	ReadOnly bool
+}
+
+// route is one endpoint of a version's handler set. pattern is a ServeMux
+// pattern with a method, and its path is relative to the version's prefix.
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// under returns the route's pattern with prefix in front of its path.
+func (rt route) under(prefix string) string {
+	method, path, _ := strings.Cut(rt.pattern, " ")
+	return method + " " + prefix + path
+}
+
+// apiVersion is a handler set mounted under /{name}.
+type apiVersion struct {
+	name   string
+	routes func(store TodoStore, events *broker, opts RouterOptions) []route
+}
+
+// apiVersions are the versions the todo API is served in. A version with a
+// different response shape, such as a v2, gets a handler set of its own:
+// typically v1Routes with the endpoints that changed swapped for new
+// handlers, and those handlers in a file of their own so the two shapes can
+// be read side by side. Versions are never changed once clients use them.
+var apiVersions = []apiVersion{
+	{name: "v1", routes: v1Routes},
+}
+
+// rootVersion is the version also served without a prefix, which has to
+// stay v1 for the clients that call /todos.
+const rootVersion = "v1"
+
+// versionedPaths returns each of paths at the root and under every version
+// prefix, for the middleware that matches on paths.
+func versionedPaths(paths ...string) []string {
+	all := append([]string(nil), paths...)
+	for _, v := range apiVersions {
+		for _, p := range paths {
+			all = append(all, "/"+v.name+p)
+		}
+	}
+	return all
+}
+
+// v1Routes is the first version of the todo API.
+func v1Routes(store TodoStore, events *broker, opts RouterOptions) []route {
+	pages := opts.Pages
+	keysOnly := isKeysOnly(opts.IDStrategy)
+	return []route{
+		{"GET /todos", resolveAfter(store, keysOnly, listTodos(store, pages, keysOnly))},
+		{"POST /todos", createTodo(store, keysOnly)},
+		{"GET /todos.csv", exportCSV(store)},
+		{"POST /todos/bulk", createTodos(store, keysOnly)},
+		{"POST /todos/import", importTodos(store)},
+		{"POST /todos/search", searchTodos(store, pages)},
+		{"DELETE /todos/completed", clearCompleted(store)},
+		{"POST /todos/bulk-delete", deleteTodos(store, keysOnly)},
+		{"POST /todos/complete-all", completeAll(store)},
+		{"POST /todos/undo", undoDelete(store)},
+		{"GET /todos/stats", todoStats(store)},
+		{"GET /todos/count", countTodos(store)},
+		{"GET /todos/today", todayTodos(store, pages, opts.Timezone)},
+		{"GET /todos/events", streamEvents(events)},
+		{"GET /ws", serveWebSocket(store, events, opts)},
+		{"POST /graphql", serveGraphQL(store, opts)},
+		{"GET /todos/{id}", getTodo(store)},
+		{"PUT /todos/{id}", updateTodo(store, keysOnly)},
+		{"PATCH /todos/{id}", patchTodo(store)},
+		{"DELETE /todos/{id}", deleteTodo(store)},
+		{"POST /todos/{id}/toggle", toggleTodo(store)},
+		{"POST /todos/{id}/restore", restoreTodo(store)},
+		{"POST /todos/{id}/archive", archiveTodo(store, TodoStore.Archive)},
+		{"POST /todos/{id}/unarchive", archiveTodo(store, TodoStore.Unarchive)},
+		{"PUT /todos/{id}/position", reorderTodo(store)},
+		{"GET /todos/{id}/children", listChildren(store)},
+		{"GET /todos/{id}/history", todoHistory(store)},
+		{"GET /todos/{id}/tags", listTags(store)},
+		{"POST /todos/{id}/tags", addTag(store)},
+		{"DELETE /todos/{id}/tags/{tag}", removeTag(store)},
+	}
+}
+
+// resolveKeys lets h's {id} be a todo's external ID, rewriting it to the
+// todo's integer id before h runs, and answers 404 if the user has no todo
+// with it. With keysOnly an integer id is refused, so todos can't be found
+// by counting.
+func resolveKeys(store TodoStore, keysOnly bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.PathValue("id")
+		key, err := validateExternalID(v)
+		if err != nil && !keysOnly {
+			// An integer id, or something pathID rejects.
+			h(w, r)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_id", "id must be a todo's UUID or ULID")
+			return
+		}
+		id, err := store.ResolveKey(r.Context(), key)
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		r.SetPathValue("id", strconv.Itoa(id))
+		h(w, r)
+	}
+}
+
+// resolveAfter is resolveKeys for the after cursor of a list route: an
+// external ID there is rewritten to the todo's integer id before h runs, and
+// with keysOnly an integer id is refused.
+func resolveAfter(store TodoStore, keysOnly bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		v := q.Get("after")
+		if _, err := validateExternalID(v); v == "" || (err != nil && !keysOnly) {
+			// No cursor, an integer id, or something parseListOptions
+			// rejects.
+			h(w, r)
+			return
+		}
+		id, ok, err := resolveRef(r.Context(), store, keysOnly, v)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("invalid after value %q: must be %s", v, refKind(keysOnly)))
+			return
+		}
+		if IsNotFound(err) {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("invalid after value %q: no todo has that ID", v))
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		r = r.Clone(r.Context())
+		q.Set("after", strconv.Itoa(id))
+		r.URL.RawQuery = q.Encode()
+		h(w, r)
+	}
+}
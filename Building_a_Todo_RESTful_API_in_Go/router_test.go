@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// serve sends a request with body to h and returns the response.
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+func TestKeysOnlyRefusesIntegerIDs(t *testing.T) {
+	store := NewInMemoryTodoStore()
+	store.IDStrategy = idUUID
+	h := NewRouter(store, nil, newBroker(), RouterOptions{IDStrategy: idUUID})
+
+	rec := serve(h, http.MethodPost, "/todos", `{"title": "a"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /todos: status = %d, want 201", rec.Code)
+	}
+	var created map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("decoding the todo: %v", err)
+	}
+	key, _ := created["external_id"].(string)
+	if _, ok := created["id"]; ok || key == "" {
+		t.Fatalf("created = %v, want an external_id and no id", created)
+	}
+	if loc := rec.Header().Get("Location"); !strings.HasSuffix(loc, "/"+key) {
+		t.Errorf("Location = %q, want it to end in the external ID", loc)
+	}
+
+	for _, c := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodGet, "/todos/1", "", http.StatusBadRequest},
+		{http.MethodGet, "/todos?ids=1", "", http.StatusBadRequest},
+		{http.MethodGet, "/todos?after=1", "", http.StatusBadRequest},
+		{http.MethodPost, "/todos/bulk-delete", `{"ids": [1]}`, http.StatusUnprocessableEntity},
+		{http.MethodGet, "/todos?ids=" + key, "", http.StatusOK},
+		{http.MethodGet, "/todos?after=" + key, "", http.StatusOK},
+	} {
+		if rec := serve(h, c.method, c.target, c.body); rec.Code != c.want {
+			t.Errorf("%s %s: status = %d, want %d", c.method, c.target, rec.Code, c.want)
+		}
+	}
+
+	var resp struct {
+		Data struct {
+			ByID       *struct{ Title string } `json:"byID"`
+			UpdateTodo *struct {
+				ID    *int
+				Title string
+			} `json:"updateTodo"`
+		}
+	}
+	query := `{"query": "mutation { updateTodo(externalId: \"` + key + `\", input: {title: \"b\"}) { id title } }"}`
+	if err := json.NewDecoder(serve(h, http.MethodPost, "/graphql", query).Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding the GraphQL response: %v", err)
+	}
+	if u := resp.Data.UpdateTodo; u == nil || u.ID != nil || u.Title != "b" {
+		t.Errorf("updateTodo = %+v, want title b and a null id", u)
+	}
+	query = `{"query": "{ byID: todo(id: 1) { title } }"}`
+	if err := json.NewDecoder(serve(h, http.MethodPost, "/graphql", query).Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding the GraphQL response: %v", err)
+	}
+	if resp.Data.ByID != nil {
+		t.Errorf("todo(id: 1) = %+v, want it refused", resp.Data.ByID)
+	}
+
+	rec = serve(h, http.MethodPost, "/todos/bulk-delete", `{"ids": ["`+key+`"]}`)
+	var deleted struct{ Deleted int }
+	if err := json.NewDecoder(rec.Body).Decode(&deleted); err != nil || deleted.Deleted != 1 {
+		t.Errorf("bulk delete by external ID: status %d, deleted %d, %v; want 1", rec.Code, deleted.Deleted, err)
+	}
+}
+
+func TestIfMatchWithIncludedTodo(t *testing.T) {
+	h := NewRouter(NewInMemoryTodoStore(), nil, newBroker(), RouterOptions{IDStrategy: idIncrement})
+	serve(h, http.MethodPost, "/todos", `{"title": "parent"}`)
+	serve(h, http.MethodPost, "/todos", `{"title": "child", "parent_id": 1}`)
+	if rec := serve(h, http.MethodPost, "/todos/1/tags", `{"tag": "work"}`); rec.Code >= 300 {
+		t.Fatalf("adding a tag: status = %d", rec.Code)
+	}
+
+	rec := serve(h, http.MethodGet, "/todos/1?include=tags,children", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"work"`) || etag == "" {
+		t.Fatalf("GET with include: status %d, ETag %q, body %s", rec.Code, etag, rec.Body)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/todos/1", strings.NewReader(`{"title": "renamed"}`))
+	req.Header.Set("If-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("PUT with the ETag of the included todo: status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestKeysOnlySubtasks(t *testing.T) {
+	store := NewInMemoryTodoStore()
+	store.IDStrategy = idULID
+	h := NewRouter(store, nil, newBroker(), RouterOptions{IDStrategy: idULID})
+
+	// create posts body and returns the todo's external ID.
+	create := func(body string) string {
+		t.Helper()
+		rec := serve(h, http.MethodPost, "/todos", body)
+		var todo struct {
+			ExternalID string `json:"external_id"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&todo); rec.Code != http.StatusCreated || err != nil {
+			t.Fatalf("POST /todos %s: status %d, %v", body, rec.Code, err)
+		}
+		return todo.ExternalID
+	}
+	parent := create(`{"title": "parent"}`)
+	child := create(`{"title": "child", "parent_id": "` + strings.ToLower(parent) + `"}`)
+
+	for _, body := range []string{
+		`{"title": "by id", "parent_id": 1}`,
+		`{"title": "unknown", "parent_id": "01ARZ3NDEKTSV4RRFFQ69G5FAV"}`,
+		`{"title": "malformed", "parent_id": "parent"}`,
+	} {
+		if rec := serve(h, http.MethodPost, "/todos", body); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("POST /todos %s: status = %d, want 422", body, rec.Code)
+		}
+	}
+
+	rec := serve(h, http.MethodGet, "/todos/"+child, "")
+	var shown map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&shown); err != nil {
+		t.Fatalf("decoding the subtask: %v", err)
+	}
+	if _, ok := shown["id"]; ok || shown["parent_id"] != parent {
+		t.Errorf("subtask = %v, want no id and parent_id %q", shown, parent)
+	}
+	for _, c := range []struct{ target, want string }{
+		{"/todos?fields=parent_id&completed=false", `[{"parent_id":null},{"parent_id":"` + parent + `"}]`},
+		{"/todos/" + parent + "/children", `"parent_id":"` + parent + `"`},
+		{"/todos/" + parent + "?include=children", `"parent_id":"` + parent + `"`},
+		{"/todos/" + child + "/history", `"parent_id":{"from":null,"to":"` + parent + `"}`},
+	} {
+		if body := serve(h, http.MethodGet, c.target, "").Body.String(); !strings.Contains(body, c.want) {
+			t.Errorf("GET %s = %s, want it to contain %s", c.target, body, c.want)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/todos/"+child, nil)
+	req.Header.Set("Accept", "application/xml")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if body := rec.Body.String(); strings.Contains(body, "<id>") || !strings.Contains(body, "<parent_id>"+parent+"</parent_id>") {
+		t.Errorf("subtask as XML = %s, want no <id> and the parent's key", body)
+	}
+
+	// What GET returned can be sent back, and a bulk create takes keys too.
+	shown["title"] = "renamed"
+	body, _ := json.Marshal(shown)
+	if rec := serve(h, http.MethodPut, "/todos/"+child, string(body)); rec.Code != http.StatusOK {
+		t.Errorf("PUT of the subtask as shown: status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	rec = serve(h, http.MethodPost, "/todos/bulk", `[{"title": "bulk", "parent_id": "`+parent+`"}, {"title": "", "parent_id": 1}]`)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"[1].title"`) || !strings.Contains(rec.Body.String(), `"[1].parent_id"`) {
+		t.Errorf("bulk create with a bad item: status %d, body %s; want 422 for [1].title and [1].parent_id", rec.Code, rec.Body)
+	}
+	rec = serve(h, http.MethodPost, "/todos/bulk", `[{"title": "bulk", "parent_id": "`+parent+`"}]`)
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"parent_id":"`+parent+`"`) {
+		t.Errorf("bulk create of a subtask: status %d, body %s", rec.Code, rec.Body)
+	}
+}
+
+// testV2Routes is a second version for TestAPIVersions: v1Routes with GET
+// /todos/{id} answering in an envelope.
+func testV2Routes(store TodoStore, events *broker, opts RouterOptions) []route {
+	routes := v1Routes(store, events, opts)
+	for i, rt := range routes {
+		if rt.pattern == "GET /todos/{id}" {
+			routes[i].handler = func(w http.ResponseWriter, r *http.Request) {
+				id, ok := pathID(w, r)
+				if !ok {
+					return
+				}
+				todo, err := store.GetByID(r.Context(), id)
+				if err != nil {
+					writeNotFound(w)
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]*Todo{"data": todo})
+			}
+		}
+	}
+	return routes
+}
+
+func TestAPIVersions(t *testing.T) {
+	defer func(versions []apiVersion) { apiVersions = versions }(apiVersions)
+	apiVersions = []apiVersion{{name: "v1", routes: v1Routes}, {name: "v2", routes: testV2Routes}}
+
+	want := []string{"/todos/search", "/v1/todos/search", "/v2/todos/search"}
+	if got := versionedPaths("/todos/search"); !slices.Equal(got, want) {
+		t.Errorf("versionedPaths = %q, want %q", got, want)
+	}
+
+	h := NewRouter(NewInMemoryTodoStore(), nil, newBroker(), RouterOptions{IDStrategy: idIncrement})
+	if rec := serve(h, http.MethodPost, "/v2/todos", `{"title": "a"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /v2/todos: status = %d, want 201", rec.Code)
+	}
+	for _, c := range []struct {
+		target   string
+		envelope bool
+	}{
+		{"/todos/1", false},
+		{"/v1/todos/1", false},
+		{"/v2/todos/1", true},
+	} {
+		rec := serve(h, http.MethodGet, c.target, "")
+		var body map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d, %v", c.target, rec.Code, err)
+		}
+		if _, ok := body["data"]; ok != c.envelope {
+			t.Errorf("GET %s = %v, want an envelope: %t", c.target, body, c.envelope)
+		}
+		if _, ok := body["title"]; ok == c.envelope {
+			t.Errorf("GET %s = %v, want a bare todo: %t", c.target, body, !c.envelope)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// schemaFiles holds the JSON schemas the write endpoints check their bodies
+// against. Their enums and limits have to be kept in step with priorities,
+// recurrences and maxTitleLength.
+//
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+var (
+	todoSchema      = mustCompileSchema("todo.json")
+	todoPatchSchema = mustCompileSchema("todo_patch.json")
+)
+
+// mustCompileSchema compiles schemas/name. The files are part of the binary,
+// so a broken one is a programming error and panics at startup.
+func mustCompileSchema(name string) *jsonschema.Schema {
+	data, err := schemaFiles.ReadFile("schemas/" + name)
+	if err != nil {
+		panic(err)
+	}
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		panic(name + ": " + err.Error())
+	}
+	c := jsonschema.NewCompiler()
+	c.AssertFormat()
+	if err := c.AddResource(name, doc); err != nil {
+		panic(err)
+	}
+	return c.MustCompile(name)
+}
+
+// fieldError is one problem a schema found with a request body. Field is
+// the dotted path to the offending value, "body" for the body itself.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+var schemaPrinter = message.NewPrinter(language.English)
+
+// fieldErrors flattens a validation error into one entry per failed
+// keyword, naming each missing or unexpected property on its own, sorted by
+// field so the same body always gets the same response.
+func fieldErrors(ve *jsonschema.ValidationError) []fieldError {
+	errs := collectFieldErrors(ve)
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+func collectFieldErrors(ve *jsonschema.ValidationError) []fieldError {
+	if len(ve.Causes) > 0 {
+		var errs []fieldError
+		for _, cause := range ve.Causes {
+			errs = append(errs, collectFieldErrors(cause)...)
+		}
+		return errs
+	}
+	path := strings.Join(ve.InstanceLocation, ".")
+	field := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+	switch k := ve.ErrorKind.(type) {
+	case *kind.Required:
+		errs := make([]fieldError, len(k.Missing))
+		for i, name := range k.Missing {
+			errs[i] = fieldError{Field: field(name), Message: "is required"}
+		}
+		return errs
+	case *kind.AdditionalProperties:
+		errs := make([]fieldError, len(k.Properties))
+		for i, name := range k.Properties {
+			errs[i] = fieldError{Field: field(name), Message: "is not a known field"}
+		}
+		return errs
+	}
+	if path == "" {
+		path = "body"
+	}
+	return []fieldError{{Field: path, Message: ve.ErrorKind.LocalizedString(schemaPrinter)}}
+}
+
+// decodeValidJSON is decodeJSON for bodies with a schema: the body is read
+// and checked against schema before it is decoded into v, and a body that
+// fails gets a 422 listing every field that is wrong rather than just the
+// first. On failure it writes the error response and returns false.
+func decodeValidJSON(w http.ResponseWriter, r *http.Request, schema *jsonschema.Schema, v interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeTooLarge(w, tooLarge)
+		return false
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return false
+	}
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		writeDecodeError(w, err)
+		return false
+	}
+	var ve *jsonschema.ValidationError
+	if err := schema.Validate(doc); errors.As(err, &ve) {
+		writeFieldErrors(w, "request body does not match the schema", fieldErrors(ve))
+		return false
+	} else if err != nil {
+		writeInternalError(w, err)
+		return false
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeDecodeError(w, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// searchRequest is the body of POST /todos/search. Every filter is optional
+// and they combine with AND.
+type searchRequest struct {
+	TitleContains string   `json:"title_contains"`
+	Completed     *bool    `json:"completed"`
+	Priorities    []string `json:"priority"`
+	// CreatedAfter and CreatedBefore take an RFC3339 timestamp or a date,
+	// like the query parameters of GET /todos.
+	CreatedAfter  string `json:"created_after"`
+	CreatedBefore string `json:"created_before"`
+	Sort          string `json:"sort"`
+	Order         string `json:"order"`
+	Limit         int    `json:"limit"`
+	Offset        int    `json:"offset"`
+}
+
+// searchResult is one page of matches and how many there are in total.
+type searchResult struct {
+	Todos  []*Todo `json:"todos"`
+	Total  int     `json:"total"`
+	Limit  int     `json:"limit"`
+	Offset int     `json:"offset"`
+}
+
+// options validates req and turns it into the ListOptions GetAll takes. The
+// sort column is checked against sortColumns and every value ends up as a
+// query argument, so nothing from the body reaches the SQL text. The limit
+// is clamped to pages.
+func (req searchRequest) options(pages PageSizes) (ListOptions, error) {
+	opts := ListOptions{
+		TodoFilter: TodoFilter{Completed: req.Completed, Query: normalizeTitle(req.TitleContains)},
+		Limit:      req.Limit,
+		Offset:     max(req.Offset, 0),
+		Sort:       "position",
+		Order:      "asc",
+	}
+	for _, p := range req.Priorities {
+		if !contains(priorities, p) {
+			return opts, &ValidationError{Field: "priority", Message: "must only contain " + strings.Join(priorities, ", ")}
+		}
+	}
+	opts.Priorities = req.Priorities
+	if req.CreatedAfter != "" {
+		after, err := parseDateParam(req.CreatedAfter)
+		if err != nil {
+			return opts, &ValidationError{Field: "created_after", Message: "must be an RFC3339 timestamp or a YYYY-MM-DD date"}
+		}
+		opts.CreatedAfter = &after
+	}
+	if req.CreatedBefore != "" {
+		before, err := parseDateParam(req.CreatedBefore)
+		if err != nil {
+			return opts, &ValidationError{Field: "created_before", Message: "must be an RFC3339 timestamp or a YYYY-MM-DD date"}
+		}
+		opts.CreatedBefore = &before
+	}
+	if opts.CreatedAfter != nil && opts.CreatedBefore != nil && !opts.CreatedAfter.Before(*opts.CreatedBefore) {
+		return opts, &ValidationError{Field: "created_after", Message: "must be before created_before"}
+	}
+	if req.Sort != "" {
+		if !contains(sortColumns, req.Sort) {
+			return opts, &ValidationError{Field: "sort", Message: "must be one of " + strings.Join(sortColumns, ", ")}
+		}
+		opts.Sort = req.Sort
+	}
+	if req.Order != "" {
+		order := strings.ToLower(req.Order)
+		if order != "asc" && order != "desc" {
+			return opts, &ValidationError{Field: "order", Message: "must be asc or desc"}
+		}
+		opts.Order = order
+	}
+	if opts.Limit == 0 {
+		opts.Limit = pages.withDefaults().Default
+	}
+	opts.Limit = pages.clamp(opts.Limit)
+	return opts, nil
+}
+
+func searchTodos(store TodoStore, pages PageSizes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req searchRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		opts, err := req.options(pages)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		todos, err := store.GetAll(r.Context(), opts)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		total, err := store.Count(r.Context(), opts.TodoFilter)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if todos == nil {
+			todos = []*Todo{}
+		}
+		writeJSON(w, http.StatusOK, searchResult{Todos: todos, Total: total, Limit: opts.Limit, Offset: opts.Offset})
+	}
+}
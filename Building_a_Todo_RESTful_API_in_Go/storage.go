@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The storage backends Config.Store can name.
+const (
+	backendSQLite   = "sqlite"
+	backendPostgres = "postgres"
+	backendMemory   = "memory"
+)
+
+// Backend is an opened storage backend.
+type Backend struct {
+	Store TodoStore
+	// DB is the database behind Store, for the health checks and backups.
+	// It is nil for the memory backend.
+	DB    *DB
+	close func() error
+}
+
+// Close releases the store, then the database if there is one.
+func (b *Backend) Close() error {
+	if b.close == nil {
+		return nil
+	}
+	return b.close()
+}
+
+// StoreFactory opens one kind of backend from the settings in cfg.
+type StoreFactory func(cfg *Config) (*Backend, error)
+
+// storeFactories maps each backend name to the factory that opens it.
+var storeFactories = map[string]StoreFactory{
+	backendSQLite:   openSQLBackend,
+	backendPostgres: openSQLBackend,
+	backendMemory:   openMemoryBackend,
+}
+
+// backendNames lists the backends storeFactories knows, for error messages.
+func backendNames() string {
+	names := make([]string, 0, len(storeFactories))
+	for name := range storeFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// OpenStore opens the backend cfg.Store names. LoadConfig has already
+// checked that it exists and agrees with DBPath.
+func OpenStore(cfg *Config) (*Backend, error) {
+	open, ok := storeFactories[cfg.Store]
+	if !ok {
+		return nil, fmt.Errorf("unknown store %q: must be one of %s", cfg.Store, backendNames())
+	}
+	return open(cfg)
+}
+
+// openSQLBackend opens DBPath with SQLite or Postgres, as NewDB decides from
+// the path, brings the schema up to date and prepares the store's
+// statements.
+func openSQLBackend(cfg *Config) (*Backend, error) {
+	db, err := NewDB(cfg.DBPath, cfg.DB)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	if err := db.EnsureMigration(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating database: %w", err)
+	}
+	store, err := NewTodoSQLStore(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("preparing statements: %w", err)
+	}
+	store.IdempotencyTTL = cfg.IdempotencyTTL
+	store.UndoDepth = cfg.UndoDepth
+	store.IDStrategy = cfg.IDStrategy
+	store.Quota = cfg.Quota
+	return &Backend{Store: store, DB: db, close: func() error {
+		return errors.Join(store.Close(), db.Close())
+	}}, nil
+}
+
+// openMemoryBackend starts an empty InMemoryTodoStore. Its todos are gone
+// once the process exits.
+func openMemoryBackend(cfg *Config) (*Backend, error) {
+	store := NewInMemoryTodoStore()
+	store.IdempotencyTTL = cfg.IdempotencyTTL
+	store.UndoDepth = cfg.UndoDepth
+	store.IDStrategy = cfg.IDStrategy
+	store.Quota = cfg.Quota
+	return &Backend{Store: store}, nil
+}
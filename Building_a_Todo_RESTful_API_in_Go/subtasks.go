@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrHasChildren is returned when deleting a todo that still has subtasks.
+// Deletes are blocked rather than cascaded so a parent can't take work with
+// it by accident; delete or move the subtasks first.
+var ErrHasChildren = errors.New("todo has subtasks")
+
+// todoInput is a todo as POST /todos, POST /todos/bulk and PUT /todos/{id}
+// take it. Its parent_id may name the parent by integer id or by external
+// ID, like a todo shown with keysOnly does.
+type todoInput struct {
+	Todo
+	ParentID json.RawMessage `json:"parent_id,omitempty"`
+}
+
+// parent resolves the input's parent_id, taking only an external ID with
+// keysOnly. It returns nil if there is none. An external ID the user has no
+// todo with is errNoParent, as Create reports an unknown integer id.
+func (in *todoInput) parent(ctx context.Context, store TodoStore, keysOnly bool) (*int, error) {
+	if len(in.ParentID) == 0 || string(in.ParentID) == "null" {
+		return nil, nil
+	}
+	// A string holds an external ID; anything else is read as is.
+	ref := string(in.ParentID)
+	json.Unmarshal(in.ParentID, &ref)
+	id, ok, err := resolveRef(ctx, store, keysOnly, ref)
+	if !ok {
+		return nil, &ValidationError{Field: "parent_id", Message: "must be " + refKind(keysOnly)}
+	}
+	if IsNotFound(err) {
+		return nil, errNoParent
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// todo returns the input as a Todo with its parent_id resolved. A parent_id
+// that doesn't resolve is reported along with the todo's other problems.
+func (in *todoInput) todo(ctx context.Context, store TodoStore, keysOnly bool) (*Todo, error) {
+	todo := in.Todo
+	parentID, err := in.parent(ctx, store, keysOnly)
+	if IsValidationError(err) {
+		errs := validationErrors(todo.validate())
+		errs.add(err)
+		return nil, errs
+	}
+	if err != nil {
+		return nil, err
+	}
+	todo.ParentID = parentID
+	return &todo, nil
+}
+
+// todoInputs is todo for the items of a bulk create. If any parent_id
+// doesn't resolve, the error lists every item's problems as CreateBulk
+// would, followed by the parent_ids under their index.
+func todoInputs(ctx context.Context, store TodoStore, keysOnly bool, inputs []*todoInput) ([]*Todo, error) {
+	todos := make([]*Todo, len(inputs))
+	var parentErrs ValidationErrors
+	for i, in := range inputs {
+		if in == nil {
+			continue
+		}
+		todo := in.Todo
+		parentID, err := in.parent(ctx, store, keysOnly)
+		if IsValidationError(err) {
+			parentErrs.add(validationErrors(err).prefixed(fmt.Sprintf("[%d].", i)))
+		} else if err != nil {
+			return nil, err
+		}
+		todo.ParentID = parentID
+		todos[i] = &todo
+	}
+	if len(parentErrs) == 0 {
+		return todos, nil
+	}
+	errs := validationErrors(validateBulk(todos))
+	return nil, append(errs, parentErrs...)
+}
+
+// errNoParent is returned for a new todo whose parent_id names no todo the
+// user can see.
+var errNoParent = &ValidationError{Field: "parent_id", Message: "must be an existing todo"}
+
+// checkParent makes sure a new todo's parent exists and is visible to the
+// caller.
+func (store *TodoSQLStore) checkParent(ctx context.Context, parentID *int) error {
+	if parentID == nil {
+		return nil
+	}
+	_, err := store.GetByID(ctx, *parentID)
+	if IsNotFound(err) {
+		return errNoParent
+	}
+	return err
+}
+
+// checkNoChildren returns ErrHasChildren if any todo has id as its parent.
+// Soft-deleted subtasks only count when includeDeleted is set, since they
+// still reference the parent row. The count isn't scoped to the caller, so
+// check first that they can see todo id.
+func (store *TodoSQLStore) checkNoChildren(ctx context.Context, id int, includeDeleted bool) error {
+	query := "SELECT COUNT(*) FROM todos WHERE parent_id = ?"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	var n int
+	if err := store.conn().QueryRowContext(ctx, query, id).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrHasChildren
+	}
+	return nil
+}
+
+// GetChildren returns the subtasks of a todo, oldest first. It returns
+// ErrTodoNotFound if the parent doesn't exist.
+func (store *TodoSQLStore) GetChildren(ctx context.Context, parentID int) ([]*Todo, error) {
+	if _, err := store.GetByID(ctx, parentID); err != nil {
+		return nil, err
+	}
+	where, args := scopeFilter(ctx, TodoFilter{}).where()
+	rows, err := store.conn().QueryContext(ctx, "SELECT "+todoColumns+" FROM todos"+where+" AND parent_id = ? ORDER BY id", append(args, parentID)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	children := []*Todo{}
+	for rows.Next() {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, todo)
+	}
+	return children, rows.Err()
+}
+
+func listChildren(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		children, err := store.GetChildren(r.Context(), id)
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeTodos(w, r, http.StatusOK, children)
+	}
+}
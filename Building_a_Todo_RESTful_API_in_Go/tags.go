@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxTagLength = 50
+
+// normalizeTag trims and lowercases a tag so "Work" and " work" are the same.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func validateTag(tag string) (string, error) {
+	tag = normalizeTag(tag)
+	if tag == "" {
+		return "", &ValidationError{Field: "tag", Message: "must not be empty"}
+	}
+	if utf8.RuneCountInString(tag) > maxTagLength {
+		return "", &ValidationError{Field: "tag", Message: fmt.Sprintf("must be at most %d characters", maxTagLength)}
+	}
+	return tag, nil
+}
+
+// tagsDiff is the audit diff of a change to a todo's tags. todoDiff leaves
+// tags out, since they aren't stored with the todo.
+func tagsDiff(before, after []string) map[string]fieldChange {
+	return map[string]fieldChange{"tags": {From: before, To: after}}
+}
+
+// AddTag attaches tag to a todo, creating the tag if it is new. Adding a tag
+// the todo already has is a no-op.
+func (store *TodoSQLStore) AddTag(ctx context.Context, todoID int, tag string) error {
+	tag, err := validateTag(tag)
+	if err != nil {
+		return err
+	}
+	return store.changeTags(ctx, todoID, func(tx *TodoSQLStore) error {
+		if _, err := tx.conn().ExecContext(ctx, "INSERT INTO tags (name) VALUES (?) ON CONFLICT (name) DO NOTHING", tag); err != nil {
+			return err
+		}
+		_, err := tx.conn().ExecContext(ctx, "INSERT INTO todo_tags (todo_id, tag_id) SELECT ?, id FROM tags WHERE name = ? ON CONFLICT DO NOTHING", todoID, tag)
+		return err
+	})
+}
+
+// RemoveTag detaches tag from a todo. Removing a tag the todo doesn't have is
+// a no-op.
+func (store *TodoSQLStore) RemoveTag(ctx context.Context, todoID int, tag string) error {
+	return store.changeTags(ctx, todoID, func(tx *TodoSQLStore) error {
+		_, err := tx.conn().ExecContext(ctx, "DELETE FROM todo_tags WHERE todo_id = ? AND tag_id IN (SELECT id FROM tags WHERE name = ?)", todoID, normalizeTag(tag))
+		return err
+	})
+}
+
+// changeTags runs change on todo id's tags in a transaction. If the tags end
+// up different, that is an update of the todo like any other: its version
+// is bumped and the change recorded in the audit log.
+func (store *TodoSQLStore) changeTags(ctx context.Context, id int, change func(tx *TodoSQLStore) error) error {
+	match, args := todoMatch(ctx, id)
+	return store.retryTx(ctx, func(tx *TodoSQLStore) error {
+		before, err := tx.GetTags(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := change(tx); err != nil {
+			return err
+		}
+		after, err := tx.GetTags(ctx, id)
+		if err != nil || slices.Equal(before, after) {
+			return err
+		}
+		res, err := tx.conn().ExecContext(ctx, "UPDATE todos SET version = version + 1, updated_at = CURRENT_TIMESTAMP, updated_by = ? WHERE "+match+" AND deleted_at IS NULL", append([]interface{}{actorID(ctx)}, args...)...)
+		if err != nil {
+			return err
+		}
+		if err := checkAffected(res); err != nil {
+			return err
+		}
+		return tx.recordAudit(ctx, id, actorID(ctx), auditUpdated, tagsDiff(before, after))
+	})
+}
+
+// GetTags lists a todo's tags in alphabetical order.
+func (store *TodoSQLStore) GetTags(ctx context.Context, todoID int) ([]string, error) {
+	if _, err := store.GetByID(ctx, todoID); err != nil {
+		return nil, err
+	}
+	rows, err := store.conn().QueryContext(ctx, "SELECT t.name FROM tags t JOIN todo_tags tt ON tt.tag_id = t.id WHERE tt.todo_id = ? ORDER BY t.name", todoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func listTags(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		tags, err := store.GetTags(r.Context(), id)
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tags)
+	}
+}
+
+func addTag(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		var input struct {
+			Tag string `json:"tag"`
+		}
+		if !decodeJSON(w, r, &input) {
+			return
+		}
+		err := store.AddTag(r.Context(), id, input.Tag)
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if IsValidationError(err) {
+			writeValidationError(w, err)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		tags, err := store.GetTags(r.Context(), id)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tags)
+	}
+}
+
+func removeTag(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		err := store.RemoveTag(r.Context(), id, r.PathValue("tag"))
+		if IsNotFound(err) {
+			writeNotFound(w)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
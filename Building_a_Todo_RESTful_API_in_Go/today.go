@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	// Embedded so ?tz= works on hosts without a zoneinfo database, such as
+	// scratch containers.
+	_ "time/tzdata"
+)
+
+// todayTodos serves GET /todos/today: the todos due during the current day
+// in tz, or in the IANA time zone named by ?tz=. Completed todos are left
+// out unless ?completed= asks for them. The other filters, paging and
+// sorting parameters of GET /todos apply as well.
+func todayTodos(store TodoStore, pages PageSizes, tz *time.Location) http.HandlerFunc {
+	pages = pages.withDefaults()
+	if tz == nil {
+		tz = time.UTC
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseListOptions(r, pages)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		loc := tz
+		if v := r.URL.Query().Get("tz"); v != "" {
+			if loc, err = time.LoadLocation(v); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("invalid tz value %q: must be an IANA time zone such as Europe/Berlin", v))
+				return
+			}
+		}
+		if opts.Completed == nil {
+			pending := false
+			opts.Completed = &pending
+		}
+		start, end := dayBounds(time.Now(), loc)
+		opts.DueAfter, opts.DueBefore = &start, &end
+
+		todos, err := store.GetAll(r.Context(), opts)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		total, err := store.Count(r.Context(), opts.TodoFilter)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		var body interface{} = todoList(todos)
+		if len(opts.Fields) > 0 {
+			body = sparseList(todos, opts.Fields)
+		}
+		writeResponse(w, r, http.StatusOK, body)
+	}
+}
+
+// dayBounds returns the start of the day now falls on in loc and the start
+// of the next one. Days aren't always 24 hours long: one with a DST change
+// is 23 or 25, which adding a day to the date rather than 24 hours to the
+// time accounts for.
+func dayBounds(now time.Time, loc *time.Location) (start, end time.Time) {
+	year, month, day := now.In(loc).Date()
+	return startOfDay(year, month, day, loc), startOfDay(year, month, day+1, loc)
+}
+
+// startOfDay returns the first instant of the given date in loc. That is
+// midnight unless the clocks go forward at midnight that day, as they do in
+// some zones: midnight doesn't exist then, time.Date may resolve it to the
+// last hour of the day before, and the day instead starts when the new
+// offset takes effect. The date is normalized the way time.Date does it.
+func startOfDay(year int, month time.Month, day int, loc *time.Location) time.Time {
+	year, month, day = time.Date(year, month, day, 12, 0, 0, 0, loc).Date()
+	t := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	if y, m, d := t.Date(); y != year || m != month || d != day {
+		if _, end := t.ZoneBounds(); !end.IsZero() {
+			return end
+		}
+	}
+	return t
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// defaultUndoDepth is how many deletes per user Undo can take back when the
+// store doesn't say otherwise.
+const defaultUndoDepth = 10
+
+// ErrNothingToUndo is returned by Undo when the caller has no delete left to
+// take back.
+var ErrNothingToUndo = errors.New("nothing to undo")
+
+// undoEntry records one delete. A soft delete only needs the ID, since the
+// row is still there; a hard delete keeps the whole todo, tags included, so
+// it can be inserted again.
+type undoEntry struct {
+	id   int
+	todo *Todo
+}
+
+// undoStack holds each user's most recent deletes, newest last. The stores
+// created by WithTx share their parent's stack.
+type undoStack struct {
+	mu      sync.Mutex
+	entries map[string][]undoEntry
+}
+
+func newUndoStack() *undoStack {
+	return &undoStack{entries: make(map[string][]undoEntry)}
+}
+
+func undoDepth(depth int) int {
+	if depth <= 0 {
+		return defaultUndoDepth
+	}
+	return depth
+}
+
+// push records a delete by the user in ctx, dropping that user's oldest
+// entry once there are more than depth.
+func (s *undoStack) push(ctx context.Context, entry undoEntry, depth int) {
+	userID, _ := UserIDFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := append(s.entries[userID], entry)
+	if len(entries) > depth {
+		entries = entries[len(entries)-depth:]
+	}
+	s.entries[userID] = entries
+}
+
+// pop removes and returns the newest delete by the user in ctx.
+func (s *undoStack) pop(ctx context.Context) (undoEntry, bool) {
+	userID, _ := UserIDFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := s.entries[userID]
+	if len(entries) == 0 {
+		return undoEntry{}, false
+	}
+	entry := entries[len(entries)-1]
+	if len(entries) == 1 {
+		delete(s.entries, userID)
+	} else {
+		s.entries[userID] = entries[:len(entries)-1]
+	}
+	return entry, true
+}
+
+// undoLatest pops entries until restore succeeds with one. Entries whose
+// todo has been restored or purged in the meantime are dropped; any other
+// failure puts the entry back so the caller can retry.
+func undoLatest(ctx context.Context, s *undoStack, depth int, restore func(undoEntry) (*Todo, error)) (*Todo, error) {
+	for {
+		entry, ok := s.pop(ctx)
+		if !ok {
+			return nil, ErrNothingToUndo
+		}
+		todo, err := restore(entry)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			s.push(ctx, entry, depth)
+			return nil, err
+		}
+		return todo, nil
+	}
+}
+
+// snapshotForUndo reads the todo a hard delete is about to remove, whether
+// or not it was soft-deleted first, along with its tags.
+func (store *TodoSQLStore) snapshotForUndo(ctx context.Context, id int) (*Todo, error) {
+	match, args := todoMatch(ctx, id)
+	todo, err := scanTodo(store.conn().QueryRowContext(ctx, "SELECT "+todoColumns+" FROM todos WHERE "+match, args...))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := store.conn().QueryContext(ctx, "SELECT t.name FROM tags t JOIN todo_tags tt ON tt.tag_id = t.id WHERE tt.todo_id = ? ORDER BY t.name", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		todo.Tags = append(todo.Tags, tag)
+	}
+	return todo, rows.Err()
+}
+
+// Undo takes back the newest Delete or HardDelete the user in ctx made and
+// returns the todo. A soft-deleted todo is restored as it was; a hard-deleted
+// one is inserted again under a new ID, keeping its fields, creation time
+// and tags, and is dropped from its parent if that is gone too. Undo returns
+// ErrNothingToUndo once the user's last UndoDepth deletes are used up.
+func (store *TodoSQLStore) Undo(ctx context.Context) (*Todo, error) {
+	return undoLatest(ctx, store.undo, undoDepth(store.UndoDepth), func(entry undoEntry) (*Todo, error) {
+		if entry.todo == nil {
+			if err := store.RestoreDeleted(ctx, entry.id); err != nil {
+				return nil, err
+			}
+			return store.GetByID(ctx, entry.id)
+		}
+		var restored *Todo
+		err := store.WithTx(ctx, func(tx *TodoSQLStore) error {
+			old := entry.todo
+			parentID := old.ParentID
+			if parentID != nil {
+				if _, err := tx.GetByID(ctx, *parentID); IsNotFound(err) {
+					parentID = nil
+				} else if err != nil {
+					return err
+				}
+			}
+			externalID := old.ExternalID
+			if externalID != nil {
+				// Another todo may have taken the external ID while this one
+				// was gone.
+				var taken bool
+				if err := tx.conn().QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM todos WHERE external_id = ?)", *externalID).Scan(&taken); err != nil {
+					return err
+				}
+				if taken {
+					externalID = nil
+				}
+			}
+			userID := actorID(ctx)
+			var id int
+			err := tx.conn().QueryRowContext(ctx, "INSERT INTO todos (title, completed, archived, due_date, priority, recurrence, parent_id, user_id, created_at, created_by, updated_by, external_id, position, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, "+nextPositionQuery+", CURRENT_TIMESTAMP) RETURNING id",
+				old.Title, old.Completed, old.Archived, old.DueDate, old.Priority, old.Recurrence, parentID, userID, old.CreatedAt, old.CreatedBy, userID, externalID, userID).Scan(&id)
+			if err != nil {
+				return err
+			}
+			for _, tag := range old.Tags {
+				if err := tx.AddTag(ctx, id, tag); err != nil {
+					return err
+				}
+			}
+			if restored, err = tx.GetByID(ctx, id); err != nil {
+				return err
+			}
+			return tx.recordAudit(ctx, id, userID, auditCreated, todoDiff(nil, restored))
+		})
+		return restored, err
+	})
+}
+
+// undoDelete serves POST /todos/undo.
+func undoDelete(store TodoStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		todo, err := store.Undo(r.Context())
+		if errors.Is(err, ErrNothingToUndo) {
+			writeJSONError(w, http.StatusNotFound, "nothing_to_undo", err.Error())
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		writeTodo(w, r, http.StatusOK, todo)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// webhookQueueSize is how many events may wait for one URL before
+	// further events to it are dropped.
+	webhookQueueSize = 1024
+	// webhookAttemptTimeout bounds a single delivery attempt.
+	webhookAttemptTimeout = 5 * time.Second
+	// webhookMaxAttempts is how often an event is tried before it is given
+	// up on.
+	webhookMaxAttempts = 5
+	// webhookBackoff is the wait before the first retry; it doubles with
+	// each one after that.
+	webhookBackoff = time.Second
+)
+
+// webhookEvent is the body POSTed for each change. It is the event
+// GET /todos/events sends, plus the owner of the todo.
+type webhookEvent struct {
+	Type       string `json:"type"`
+	ID         int    `json:"id,omitempty"`
+	ExternalID string `json:"external_id,omitempty"`
+	UserID     string `json:"user_id,omitempty"`
+	Todo       *Todo  `json:"todo,omitempty"`
+}
+
+// runWebhooks POSTs every change published on b to each of urls until ctx
+// is cancelled. Each URL has its own queue and delivers in order, so a slow
+// or failing endpoint doesn't hold up the others or any API request.
+// Failed attempts are retried with exponential backoff and logged; events
+// still queued at shutdown are dropped.
+func runWebhooks(ctx context.Context, b *broker, urls []string, logger *slog.Logger) {
+	client := &http.Client{Timeout: webhookAttemptTimeout}
+	done := make(chan struct{})
+	for _, url := range urls {
+		events, unsubscribe := b.subscribe("", webhookQueueSize)
+		go func() {
+			defer func() { done <- struct{}{} }()
+			defer unsubscribe()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ev := <-events:
+					deliverWebhook(ctx, client, url, ev, logger)
+				}
+			}
+		}()
+	}
+	for range urls {
+		<-done
+	}
+}
+
+// deliverWebhook POSTs ev to url, retrying until it is accepted, the
+// attempts run out or ctx is cancelled.
+func deliverWebhook(ctx context.Context, client *http.Client, url string, ev todoEvent, logger *slog.Logger) {
+	body := webhookEvent{Type: ev.Type, ID: ev.ID, ExternalID: ev.ExternalID, UserID: ev.userID, Todo: ev.Todo}
+	wait := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := postJSON(ctx, client, url, body)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if attempt == webhookMaxAttempts {
+			logger.Error("webhook delivery failed, giving up", "url", url, "event", ev.Type, "id", ev.ID, "attempts", attempt, "error", err)
+			return
+		}
+		logger.Warn("webhook delivery failed, retrying", "url", url, "event", ev.Type, "id", ev.ID, "attempt", attempt, "retry_in", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteWait bounds how long one message may take to write.
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long the connection may stay silent, pongs
+	// included, before it is considered dead.
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod must be shorter than wsPongWait so a live client always
+	// has a ping to answer.
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsCommandTimeout plays the part withTimeout does for HTTP requests.
+	wsCommandTimeout = 30 * time.Second
+	wsMaxMessage     = 64 << 10
+)
+
+// The default origin check only lets same-origin pages connect, which keeps
+// other sites from driving a logged-in user's socket.
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// wsCommand is a message from the client. Ref is echoed back in the reply so
+// the client can match them up.
+type wsCommand struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref,omitempty"`
+	// ID or ExternalID names the todo a toggle is for; only ExternalID
+	// under the idUUID and idULID strategies.
+	ID         int             `json:"id,omitempty"`
+	ExternalID string          `json:"external_id,omitempty"`
+	Todo       json.RawMessage `json:"todo,omitempty"`
+}
+
+// wsReply answers one wsCommand with either the todo or an error.
+type wsReply struct {
+	Type  string       `json:"type"`
+	Ref   string       `json:"ref,omitempty"`
+	Todo  *Todo        `json:"todo,omitempty"`
+	Error *errorDetail `json:"error,omitempty"`
+}
+
+// serveWebSocket serves /ws. Every change the caller may see is pushed as
+// the same event GET /todos/events sends, and the client can send
+//
+//	{"type": "create", "ref": "1", "todo": {"title": "..."}}
+//	{"type": "toggle", "ref": "2", "id": 3}
+//
+// which are answered with {"type": "ack", "ref": ..., "todo": ...} or
+// {"type": "error", "ref": ..., "error": {...}}. Changes go through store,
+// so they are broadcast to every connected client, the sender included.
+// With opts.ReadOnly set, events are still pushed but every command is
+// refused.
+func serveWebSocket(store TodoStore, b *broker, opts RouterOptions) http.HandlerFunc {
+	keysOnly := isKeysOnly(opts.IDStrategy)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok {
+			b.closeOnShutdown(srv)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has already replied.
+			recordError(w, err)
+			return
+		}
+		defer conn.Close()
+
+		userID, _ := UserIDFromContext(r.Context())
+		events, unsubscribe := b.subscribe(userID, subscriberBuffer)
+		defer unsubscribe()
+
+		replies := make(chan wsReply, subscriberBuffer)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			readCommands(r.Context(), conn, store, opts.ReadOnly, keysOnly, replies)
+		}()
+
+		// Only this goroutine writes to conn, as gorilla/websocket requires.
+		ping := time.NewTicker(wsPingPeriod)
+		defer ping.Stop()
+		for {
+			var err error
+			select {
+			case <-done:
+				return
+			case <-b.done:
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(wsWriteWait))
+				return
+			case ev := <-events:
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				err = conn.WriteJSON(ev)
+			case reply := <-replies:
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				err = conn.WriteJSON(reply)
+			case <-ping.C:
+				err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readCommands runs the commands read from conn until it is closed, sending
+// each reply to replies. Both commands write, so in readOnly mode they are
+// all answered with a read_only error instead.
+func readCommands(ctx context.Context, conn *websocket.Conn, store TodoStore, readOnly, keysOnly bool, replies chan<- wsReply) {
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		var cmd wsCommand
+		var reply wsReply
+		err := conn.ReadJSON(&cmd)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+			reply = wsError("", "bad_request", "message must be a JSON command")
+		case err != nil:
+			return
+		case readOnly:
+			reply = wsError(cmd.Ref, "read_only", readOnlyMessage)
+		default:
+			reply = runCommand(ctx, store, keysOnly, cmd)
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		select {
+		case replies <- reply:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func runCommand(ctx context.Context, store TodoStore, keysOnly bool, cmd wsCommand) wsReply {
+	ctx, cancel := context.WithTimeout(ctx, wsCommandTimeout)
+	defer cancel()
+
+	var todo *Todo
+	var err error
+	switch cmd.Type {
+	case "create":
+		var input Todo
+		dec := json.NewDecoder(bytes.NewReader(cmd.Todo))
+		dec.DisallowUnknownFields()
+		if len(cmd.Todo) == 0 || dec.Decode(&input) != nil {
+			return wsError(cmd.Ref, "bad_request", "todo must be a todo object")
+		}
+		todo, err = store.Create(ctx, &input)
+	case "toggle":
+		id := cmd.ID
+		if cmd.ExternalID != "" || keysOnly {
+			var ok bool
+			if id, ok, err = resolveRef(ctx, store, keysOnly, cmd.ExternalID); !ok {
+				return wsError(cmd.Ref, "bad_request", "external_id must be a todo's UUID or ULID")
+			}
+		}
+		if err == nil {
+			todo, err = store.ToggleCompleted(ctx, id)
+		}
+	default:
+		return wsError(cmd.Ref, "bad_request", "type must be create or toggle")
+	}
+
+	switch {
+	case err == nil:
+		return wsReply{Type: "ack", Ref: cmd.Ref, Todo: todo}
+	case IsValidationError(err):
+		return wsError(cmd.Ref, "validation_error", err.Error())
+	case IsNotFound(err):
+		return wsError(cmd.Ref, "not_found", "todo not found")
+	}
+	slog.ErrorContext(ctx, "websocket command failed", "type", cmd.Type, "error", err)
+	return wsError(cmd.Ref, "internal_error", internalErrorMessage)
+}
+
+func wsError(ref, code, message string) wsReply {
+	return wsReply{Type: "error", Ref: ref, Error: &errorDetail{Code: code, Message: message}}
+}